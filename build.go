@@ -0,0 +1,412 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// splitList splits an option value holding several names or patterns,
+// separated by spaces or commas.
+func splitList(value string) []string {
+    return strings.FieldsFunc(value, func(r rune) bool {
+        return r == ',' || r == ' ' || r == '\t'
+    })
+}
+
+// ruleList returns every entry of a list option of a rule, such as the
+// rules it needs or its input patterns.
+func ruleList(rule *Rule, key string) []string {
+    var list []string
+    for _, value := range rule.Options[key] {
+        list = append(list, splitList(value)...)
+    }
+    return list
+}
+
+// isBuildRule reports whether a rule takes part in baby build.
+func isBuildRule(rule *Rule) bool {
+    return len(rule.Options["needs"]) > 0 || len(rule.Options["inputs"]) > 0 || len(rule.Options["outputs"]) > 0
+}
+
+// buildJobs is the number of rules baby build runs at the same time when
+// -j isn't given.
+func buildJobs() int {
+    return getIntSetting("build.jobs", runtime.NumCPU())
+}
+
+// resolveBuildGraph returns the targets and every rule they need, directly
+// or not, with each rule after the rules it needs. Without targets, every
+// build rule that no other rule needs is a target.
+func resolveBuildGraph(targets []string) ([]*Rule, error) {
+    rules, err := loadRules()
+    if err != nil {
+        return nil, err
+    }
+    byName := make(map[string]*Rule)
+    for _, rule := range rules {
+        byName[rule.Name] = rule
+    }
+
+    if len(targets) == 0 {
+        needed := make(map[string]bool)
+        for _, rule := range rules {
+            for _, name := range ruleList(rule, "needs") {
+                needed[name] = true
+            }
+        }
+        var candidates []string
+        for _, rule := range rules {
+            if !isBuildRule(rule) {
+                continue
+            }
+            candidates = append(candidates, rule.Name)
+            if !needed[rule.Name] {
+                targets = append(targets, rule.Name)
+            }
+        }
+        if len(targets) == 0 {
+            // Only a cycle leaves no rule unneeded, visiting them reports it
+            targets = candidates
+        }
+        if len(targets) == 0 {
+            return nil, fmt.Errorf("no rule declares needs, inputs or outputs")
+        }
+    }
+
+    const (
+        visiting = 1
+        visited  = 2
+    )
+    state := make(map[string]int)
+    var order []*Rule
+    var path []string
+    var visit func(name, neededBy string) error
+    visit = func(name, neededBy string) error {
+        switch state[name] {
+        case visited:
+            return nil
+        case visiting:
+            start := 0
+            for path[start] != name {
+                start++
+            }
+            return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path[start:], " -> "), name)
+        }
+        rule, ok := byName[name]
+        if !ok {
+            if neededBy != "" {
+                return fmt.Errorf("rule '%s' needed by '%s' not found", name, neededBy)
+            }
+            return fmt.Errorf("rule '%s' not found", name)
+        }
+
+        state[name] = visiting
+        path = append(path, name)
+        for _, need := range ruleList(rule, "needs") {
+            if err := visit(need, name); err != nil {
+                return err
+            }
+        }
+        path = path[:len(path)-1]
+        state[name] = visited
+        order = append(order, rule)
+        return nil
+    }
+    for _, target := range targets {
+        if err := visit(target, ""); err != nil {
+            return nil, err
+        }
+    }
+    return order, nil
+}
+
+// expandPatterns returns the files matched by file patterns, relative to
+// dir when it is set. A directory stands for every file under it.
+func expandPatterns(dir string, patterns []string) ([]string, []string) {
+    var files, unmatched []string
+    for _, pattern := range patterns {
+        pattern = expandHome(pattern)
+        if !filepath.IsAbs(pattern) && dir != "" {
+            pattern = filepath.Join(dir, pattern)
+        }
+        matches, _ := filepath.Glob(pattern)
+        if len(matches) == 0 {
+            unmatched = append(unmatched, pattern)
+        }
+        for _, match := range matches {
+            filepath.WalkDir(match, func(path string, entry fs.DirEntry, err error) error {
+                if err == nil && !entry.IsDir() {
+                    files = append(files, path)
+                }
+                return nil
+            })
+        }
+    }
+    return files, unmatched
+}
+
+// upToDate reports whether every output of a rule exists and is newer
+// than all of its inputs. Rules without outputs always run.
+func upToDate(p *preparedRule) bool {
+    if len(p.outputs) == 0 {
+        return false
+    }
+    outputs, missing := expandPatterns(p.dir, p.outputs)
+    if len(missing) > 0 || len(outputs) == 0 {
+        return false
+    }
+    var oldestOutput time.Time
+    for _, path := range outputs {
+        info, err := os.Stat(path)
+        if err != nil {
+            return false
+        }
+        if oldestOutput.IsZero() || info.ModTime().Before(oldestOutput) {
+            oldestOutput = info.ModTime()
+        }
+    }
+
+    inputs, _ := expandPatterns(p.dir, p.inputs)
+    for _, path := range inputs {
+        if info, err := os.Stat(path); err == nil && info.ModTime().After(oldestOutput) {
+            return false
+        }
+    }
+    return true
+}
+
+// buildNode is a rule of a build and its progress.
+type buildNode struct {
+    index int
+    p     *preparedRule
+    needs []string
+    state string
+    // ran is set when the rule was executed rather than up to date, which
+    // makes the rules that need it run too
+    ran bool
+}
+
+// buildRules runs the targets and the rules they need in dependency order,
+// up to jobs rules at the same time. Rules whose outputs are newer than
+// their inputs are skipped, unless a rule they need ran.
+func buildRules(targets []string, bottleValues map[string]string, opts runOptions, jobs int) error {
+    rules, err := resolveBuildGraph(targets)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return err
+    }
+    if jobs < 1 {
+        jobs = 1
+    }
+
+    // Bottles and confirmations are asked for before anything runs, the
+    // rules may run side by side afterwards
+    var nodes []*buildNode
+    byName := make(map[string]*buildNode)
+    for i, rule := range rules {
+        p, err := prepareRule(rule, bottleValues, opts)
+        if err != nil {
+            fmt.Println("Error:", err)
+            return err
+        }
+        node := &buildNode{index: i, p: p, needs: ruleList(rule, "needs"), state: "pending"}
+        nodes = append(nodes, node)
+        byName[rule.Name] = node
+    }
+    // A rule only runs next to others when a rule of the build neither
+    // needs it nor is needed by it, a chain of rules keeps the terminal
+    if jobs > 1 {
+        needed := make(map[string]map[string]bool)
+        for _, node := range nodes {
+            all := make(map[string]bool)
+            for _, need := range node.needs {
+                all[need] = true
+                for name := range needed[need] {
+                    all[name] = true
+                }
+            }
+            needed[node.p.rule.Name] = all
+        }
+        for _, node := range nodes {
+            for _, other := range nodes {
+                a, b := node.p.rule.Name, other.p.rule.Name
+                if a != b && !needed[a][b] && !needed[b][a] {
+                    node.p.parallel = true
+                    break
+                }
+            }
+        }
+    }
+    for _, node := range nodes {
+        if !confirmRule(node.p, opts) {
+            fmt.Println("Operation cancelled.")
+            return fmt.Errorf("rule '%s' was not confirmed", node.p.rule.Name)
+        }
+    }
+    opts.yes = true
+
+    runID := newRunID()
+    history := newHistoryEntry(runID, targets)
+    opts.recorder = startRecording(opts, runID, append([]string{"build"}, targets...))
+    defer finishRecording(opts.recorder, runID)
+    history.Build = true
+    history.setBottles(bottleValues)
+    var prepared []*preparedRule
+    for _, node := range nodes {
+        prepared = append(prepared, node.p)
+    }
+    history.setRuleBottles(prepared)
+    var firstErr error
+    defer func() {
+        saveRun(history, firstErr, opts.reports)
+    }()
+    defer pruneRunOutputs()
+
+    type buildResult struct {
+        node *buildNode
+        err  error
+    }
+    results := make(chan buildResult)
+    running := 0
+    stopped := false
+    for {
+        // The nodes are in dependency order, so a single pass sees the
+        // rules that just became up to date
+        for _, node := range nodes {
+            if stopped || running >= jobs {
+                break
+            }
+            if node.state != "pending" {
+                continue
+            }
+
+            ready, needRan := true, false
+            for _, need := range node.needs {
+                if byName[need].state != "done" {
+                    ready = false
+                }
+                needRan = needRan || byName[need].ran
+            }
+            if !ready {
+                continue
+            }
+
+            if !needRan && upToDate(node.p) {
+                node.state = "done"
+                fmt.Printf("Rule '%s' is up to date.\n", node.p.rule.Name)
+                logWarning(writeLog(logEntry{Event: "EXECUTE_UP_TO_DATE", Rule: node.p.rule.Name, RunID: runID, Result: "up to date",
+                    Details: fmt.Sprintf("Name: %s, Run: %s", node.p.rule.Name, runID)}))
+                history.addResult(node.p.rule.Name, node.p.command, node.p.dir, "up to date", nil, 0, nil)
+                continue
+            }
+
+            node.state = "running"
+            running++
+            go func(node *buildNode) {
+                results <- buildResult{node: node, err: runPreparedRule(node.index, node.p, runID, history, opts)}
+            }(node)
+        }
+
+        if running == 0 {
+            break
+        }
+        result := <-results
+        running--
+        result.node.ran = true
+        if result.err == nil {
+            result.node.state = "done"
+            continue
+        }
+        result.node.state = "failed"
+        if firstErr == nil {
+            firstErr = result.err
+        }
+        // Like make, nothing new starts after a failure, the rules that
+        // are running are left to finish
+        stopped = true
+    }
+
+    for _, node := range nodes {
+        if node.state == "pending" {
+            history.addResult(node.p.rule.Name, node.p.command, node.p.dir, "not run", nil, 0, nil)
+        }
+    }
+    if usageSummaryEnabled(opts) {
+        showUsageSummary(history.Results)
+    }
+    return firstErr
+}
+
+// showGraph prints the dependency graph of the targets, or of every build
+// rule, in the DOT format of Graphviz. An arrow goes from a rule to each
+// rule it needs.
+func showGraph(targets []string) {
+    rules, err := resolveBuildGraph(targets)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    fmt.Println("digraph baby {")
+    fmt.Println("    rankdir=LR;")
+    for _, rule := range rules {
+        label := rule.Name
+        if outputs := ruleList(rule, "outputs"); len(outputs) > 0 {
+            sort.Strings(outputs)
+            label += "\n" + strings.Join(outputs, " ")
+        }
+        fmt.Printf("    %q [shape=box, label=%q];\n", rule.Name, label)
+    }
+    for _, rule := range rules {
+        for _, need := range ruleList(rule, "needs") {
+            fmt.Printf("    %q -> %q;\n", rule.Name, need)
+        }
+    }
+    fmt.Println("}")
+}
+
+// prefixWriter starts every line written to w with prefix, so the output
+// of rules running side by side can be told apart.
+type prefixWriter struct {
+    mu     sync.Mutex
+    w      io.Writer
+    prefix string
+    buf    []byte
+}
+
+func (pw *prefixWriter) Write(b []byte) (int, error) {
+    pw.mu.Lock()
+    defer pw.mu.Unlock()
+    pw.buf = append(pw.buf, b...)
+    for {
+        i := bytes.IndexByte(pw.buf, '\n')
+        if i < 0 {
+            break
+        }
+        line := append([]byte(pw.prefix), pw.buf[:i+1]...)
+        if _, err := pw.w.Write(line); err != nil {
+            return 0, err
+        }
+        pw.buf = pw.buf[i+1:]
+    }
+    return len(b), nil
+}
+
+// Flush writes the last line if it didn't end with a newline.
+func (pw *prefixWriter) Flush() {
+    pw.mu.Lock()
+    defer pw.mu.Unlock()
+    if len(pw.buf) > 0 {
+        pw.w.Write(append(append([]byte(pw.prefix), pw.buf...), '\n'))
+        pw.buf = nil
+    }
+}
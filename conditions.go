@@ -0,0 +1,222 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "os/user"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// conditionKeys are the rule options that must hold before the rule runs.
+var conditionKeys = []string{"if-file", "if-bin", "if-host", "if-user", "if-check"}
+
+// condition is a condition option of a rule with its bottles filled.
+type condition struct {
+    key   string
+    value string
+}
+
+func (c condition) String() string {
+    return c.key + " " + c.value
+}
+
+// ruleConditions returns the conditions of a rule in a stable order.
+func ruleConditions(rule *Rule) []condition {
+    var conditions []condition
+    for _, key := range conditionKeys {
+        for _, value := range rule.Options[key] {
+            conditions = append(conditions, condition{key: key, value: value})
+        }
+    }
+    return conditions
+}
+
+// checkCondition reports whether a condition holds and explains the result.
+// dir and env are the working directory and environment of the rule.
+func checkCondition(c condition, dir string, env []string) (bool, string) {
+    switch c.key {
+    case "if-file":
+        path := expandHome(c.value)
+        if !filepath.IsAbs(path) && dir != "" {
+            path = filepath.Join(dir, path)
+        }
+        if _, err := os.Stat(path); err != nil {
+            return false, fmt.Sprintf("%s does not exist", path)
+        }
+        return true, fmt.Sprintf("%s exists", path)
+
+    case "if-bin":
+        return checkBinary(c.value)
+
+    case "if-host":
+        hostname, err := os.Hostname()
+        if err != nil {
+            return false, fmt.Sprintf("the hostname is unknown: %v", err)
+        }
+        if matchAny(c.value, hostname) {
+            return true, fmt.Sprintf("the hostname is %s", hostname)
+        }
+        return false, fmt.Sprintf("the hostname is %s, not %s", hostname, c.value)
+
+    case "if-user":
+        name := os.Getenv("USER")
+        if u, err := user.Current(); err == nil {
+            name = u.Username
+        }
+        if matchAny(c.value, name) {
+            return true, fmt.Sprintf("the user is %s", name)
+        }
+        return false, fmt.Sprintf("the user is %s, not %s", name, c.value)
+
+    case "if-check":
+        cmd := exec.Command("bash", "-c", c.value)
+        cmd.Dir = dir
+        cmd.Env = env
+        if err := cmd.Run(); err != nil {
+            return false, fmt.Sprintf("'%s' failed: %v", c.value, err)
+        }
+        return true, fmt.Sprintf("'%s' succeeded", c.value)
+    }
+    return false, fmt.Sprintf("unknown condition %s", c.key)
+}
+
+// checkInSandbox runs the command of an if-check condition in the sandbox.
+// The files it tries to change are thrown away without a report. A check
+// that can't be run is unknown, which doesn't count as holding.
+func checkInSandbox(c condition, dir string, env []string) (bool, string) {
+    cmd, box, err := sandboxedCommand(exec.Command("bash", "-c", c.value))
+    if err != nil {
+        return false, fmt.Sprintf("unknown, '%s' can't run in the sandbox: %v", c.value, err)
+    }
+    cmd.Dir = dir
+    cmd.Env = env
+    cmd.SysProcAttr = &syscall.SysProcAttr{}
+    sandboxAttr(cmd.SysProcAttr)
+    err = cmd.Run()
+    if failure := box.discard(); failure != "" {
+        return false, fmt.Sprintf("unknown, '%s' can't run in the sandbox: %s", c.value, failure)
+    }
+    if _, exited := err.(*exec.ExitError); err != nil && !exited {
+        return false, fmt.Sprintf("unknown, '%s' can't run in the sandbox: %v", c.value, err)
+    }
+    if err != nil {
+        return false, fmt.Sprintf("'%s' failed in the sandbox: %v", c.value, err)
+    }
+    return true, fmt.Sprintf("'%s' succeeded in the sandbox", c.value)
+}
+
+// matchAny matches value against a comma separated list of shell patterns.
+func matchAny(patterns, value string) bool {
+    for _, pattern := range strings.Split(patterns, ",") {
+        if ok, _ := filepath.Match(strings.TrimSpace(pattern), value); ok {
+            return true
+        }
+    }
+    return false
+}
+
+var versionRegexp = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// checkBinary checks an if-bin condition: a program on PATH, optionally
+// with a minimum version, e.g. "docker>=20.10".
+func checkBinary(spec string) (bool, string) {
+    name, minVersion := spec, ""
+    if i := strings.Index(spec, ">="); i >= 0 {
+        name, minVersion = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+2:])
+    }
+
+    path, err := exec.LookPath(name)
+    if err != nil {
+        return false, fmt.Sprintf("%s is not on PATH", name)
+    }
+    if minVersion == "" {
+        return true, fmt.Sprintf("%s is %s", name, path)
+    }
+
+    output, _ := exec.Command(path, "--version").CombinedOutput()
+    version := versionRegexp.FindString(string(output))
+    if version == "" {
+        return false, fmt.Sprintf("the version of %s is unknown", name)
+    }
+    if compareVersions(version, minVersion) < 0 {
+        return false, fmt.Sprintf("%s %s is older than %s", name, version, minVersion)
+    }
+    return true, fmt.Sprintf("%s %s is at least %s", name, version, minVersion)
+}
+
+// compareVersions compares dotted numeric versions like 1.10.2 and 1.9.
+func compareVersions(a, b string) int {
+    aParts := strings.Split(a, ".")
+    bParts := strings.Split(b, ".")
+    for i := 0; i < len(aParts) || i < len(bParts); i++ {
+        var x, y int
+        if i < len(aParts) {
+            x, _ = strconv.Atoi(aParts[i])
+        }
+        if i < len(bParts) {
+            y, _ = strconv.Atoi(bParts[i])
+        }
+        if x != y {
+            if x < y {
+                return -1
+            }
+            return 1
+        }
+    }
+    return 0
+}
+
+// unmetConditions returns the explanation of every condition of a prepared
+// rule that doesn't hold.
+func unmetConditions(p *preparedRule) []string {
+    var unmet []string
+    for _, c := range p.conditions {
+        check := checkCondition
+        if p.sandbox && c.key == "if-check" {
+            // The check is a command, it runs in a sandbox of its own
+            check = checkInSandbox
+        }
+        if ok, explanation := check(c, p.dir, p.env); !ok {
+            unmet = append(unmet, fmt.Sprintf("%s (%s)", c, explanation))
+        }
+    }
+    return unmet
+}
+
+// showConditions prints the conditions of a rule for baby -ln and whether
+// they currently hold. if-check conditions are only listed, a listing
+// doesn't run commands.
+func showConditions(rule *Rule) {
+    conditions := ruleConditions(rule)
+    if len(conditions) == 0 {
+        return
+    }
+
+    onUnmet := rule.option("on-unmet")
+    if onUnmet == "" {
+        onUnmet = "fail"
+    }
+    fmt.Printf("Conditions (%s when unmet):\n", onUnmet)
+    dir := expandHome(rule.option("cwd"))
+    for _, c := range conditions {
+        if bottleRegexp.MatchString(c.value) || bottleRegexp.MatchString(dir) {
+            fmt.Printf("  %s: can't be checked, it uses bottles\n", c)
+            continue
+        }
+        if c.key == "if-check" {
+            fmt.Printf("  %s: not checked, it runs a command\n", c)
+            continue
+        }
+        ok, explanation := checkCondition(c, dir, nil)
+        status := "passes"
+        if !ok {
+            status = "fails"
+        }
+        fmt.Printf("  %s: %s, %s\n", c, status, explanation)
+    }
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+const (
+    logTimeFormat = "2006-01-02 15:04:05"
+    // Default rotation of baby.log
+    defaultLogMaxSize = 10 << 20
+    defaultLogKeep    = 5
+    // hiddenValue replaces what the privacy settings keep out of the log
+    hiddenValue = "[hidden]"
+)
+
+var (
+    // logSecrets are the values of the secret bottles of the run, longest
+    // first, masked in every event like in the history
+    logSecrets   []string
+    logSecretsMu sync.Mutex
+)
+
+// hideSecretsInLog makes writeLog mask the values of the secret bottles in
+// the commands and details of the next events.
+func hideSecretsInLog(bottles map[string]string) {
+    logSecretsMu.Lock()
+    defer logSecretsMu.Unlock()
+    for name, value := range bottles {
+        if value == "" || !secretBottleRegexp.MatchString(name) {
+            continue
+        }
+        known := false
+        for _, secret := range logSecrets {
+            known = known || secret == value
+        }
+        if !known {
+            logSecrets = append(logSecrets, value)
+        }
+    }
+    sort.Slice(logSecrets, func(i, j int) bool { return len(logSecrets[i]) > len(logSecrets[j]) })
+}
+
+func maskLogSecrets(s string) string {
+    logSecretsMu.Lock()
+    defer logSecretsMu.Unlock()
+    for _, secret := range logSecrets {
+        s = strings.ReplaceAll(s, secret, maskedValue)
+    }
+    return s
+}
+
+// optionLogValue is the value of an option as it is logged: log.command
+// set to false hides the options that hold commands as well.
+func optionLogValue(key, value string) string {
+    switch {
+    case getBoolSetting("log.command", true):
+    case key == "before", key == "after", key == "step", key == "if-check", strings.HasPrefix(key, variantPrefix):
+        return hiddenValue
+    }
+    return value
+}
+
+// logEntry is an event of baby.log. In the default json format every entry
+// is a line with these fields, the text format keeps the older
+// "[time] EVENT user at ip | details" lines.
+type logEntry struct {
+    Time     time.Time      `json:"time"`
+    Event    string         `json:"event"`
+    User     string         `json:"user,omitempty"`
+    IP       string         `json:"ip,omitempty"`
+    Rule     string         `json:"rule,omitempty"`
+    Command  string         `json:"command,omitempty"`
+    ExitCode *int           `json:"exit_code,omitempty"`
+    // Duration is in seconds
+    Duration *float64       `json:"duration,omitempty"`
+    RunID    string         `json:"run_id,omitempty"`
+    Result   string         `json:"result,omitempty"`
+    Usage    *resourceUsage `json:"usage,omitempty"`
+    Details  string         `json:"details,omitempty"`
+    // Pruned is the hash of the last event of a rotated file that was
+    // removed, recorded by a LOG_PRUNED event
+    Pruned   string         `json:"pruned,omitempty"`
+    // Prev is the hash of the event before, Hash the hash of this one. They
+    // are last in the line, see chainLine.
+    Prev     string         `json:"prev,omitempty"`
+    Hash     string         `json:"hash,omitempty"`
+}
+
+// withExit sets the exit code and duration of an entry from the result of
+// a command.
+func (e logEntry) withExit(err error, duration time.Duration) logEntry {
+    code := exitCodeOf(err)
+    seconds := duration.Seconds()
+    e.ExitCode = &code
+    e.Duration = &seconds
+    return e
+}
+
+func logPath() string {
+    return filepath.Join(os.Getenv("HOME"), logDir, logFileName)
+}
+
+// logEvent writes an event that isn't about a single rule.
+func logEvent(eventType, details string) error {
+    return writeLog(logEntry{Event: eventType, Details: details})
+}
+
+// writeLog appends an entry to baby.log, rotating the file first when it
+// got too big or too old. A lock file keeps baby processes that log at the
+// same time from rotating twice, writing into a rotated file or linking
+// their events to the same previous one.
+func writeLog(e logEntry) error {
+    e.Time = time.Now()
+    user, ip := hiddenValue, hiddenValue
+    if getBoolSetting("log.user", true) {
+        e.User = os.Getenv("USER")
+        user = e.User
+    }
+    if getBoolSetting("log.ip", true) {
+        e.IP = getIP()
+        ip = e.IP
+    }
+    e.Command, e.Details = maskLogSecrets(e.Command), maskLogSecrets(e.Details)
+    if !getBoolSetting("log.command", true) && e.Command != "" {
+        e.Details = strings.ReplaceAll(e.Details, e.Command, hiddenValue)
+        e.Command = hiddenValue
+    }
+    // The sinks get the event once the lock is released, even when the
+    // file couldn't be written
+    defer forwardLog(e)
+
+    path := logPath()
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("failed to create log directory: %v", err)
+    }
+    lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open log lock: %v", err)
+    }
+    defer lock.Close()
+    if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+        return fmt.Errorf("failed to lock log file: %v", err)
+    }
+    defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+    // The event links to the last one, even when the rotation drops it
+    text := getSetting("log.format", "json") == "text"
+    prev := ""
+    if !text {
+        prev = lastLogHash(path)
+    }
+    pruned, err := rotateLog(path)
+    if err != nil {
+        fmt.Printf("Warning: Failed to rotate the log: %v\n", err)
+    }
+
+    // Only JSON events are chained, the text format has no room for hashes
+    var line string
+    if text {
+        line = fmt.Sprintf("[%s] %s %s at %s | %s\n", e.Time.Format(logTimeFormat), e.Event, user, ip, e.Details)
+    } else {
+        events := []logEntry{e}
+        if pruned != "" {
+            // Without it a log whose first events were cut out would look
+            // like one whose oldest file was rotated away
+            events = []logEntry{{Time: e.Time, Event: "LOG_PRUNED", Pruned: pruned,
+                Details: fmt.Sprintf("Last hash: %s", pruned)}, e}
+        }
+        for _, event := range events {
+            event.Prev, event.Hash = prev, ""
+            data, err := json.Marshal(event)
+            if err != nil {
+                return fmt.Errorf("failed to encode log event: %v", err)
+            }
+            if data, err = chainLine(data); err != nil {
+                return err
+            }
+            line += string(data) + "\n"
+            prev = hashOf(string(data))
+        }
+    }
+
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open log file: %v", err)
+    }
+    defer file.Close()
+    if _, err := file.WriteString(line); err != nil {
+        return fmt.Errorf("failed to write to log file: %v", err)
+    }
+    return nil
+}
+
+// rotateLog moves baby.log to baby.log.1.gz when it is bigger than
+// log.max-size or its first event is older than log.max-age. Older files
+// move up by one and only log.keep of them are kept. It returns the hash
+// of the last event of the file it removed, if any.
+func rotateLog(path string) (string, error) {
+    info, err := os.Stat(path)
+    if err != nil || info.Size() == 0 {
+        return "", nil
+    }
+
+    maxSize := int64(defaultLogMaxSize)
+    if value := getSetting("log.max-size", ""); value != "" {
+        if maxSize, err = parseSize(value); err != nil {
+            return "", fmt.Errorf("invalid log.max-size: %v", err)
+        }
+    }
+    rotate := info.Size() >= maxSize
+    if maxAge := getDurationSetting("log.max-age", 0); !rotate && maxAge > 0 {
+        if first, ok := firstLogTime(path); ok && time.Since(first) > maxAge {
+            rotate = true
+        }
+    }
+    if !rotate {
+        return "", nil
+    }
+
+    keep := getIntSetting("log.keep", defaultLogKeep)
+    if keep < 1 {
+        return lastFileHash(path), os.Remove(path)
+    }
+    // Rotated files are compressed unless log.compress was off back then
+    pruned := ""
+    for _, suffix := range []string{"", ".gz"} {
+        oldest := fmt.Sprintf("%s.%d%s", path, keep, suffix)
+        if _, err := os.Stat(oldest); err == nil {
+            pruned = lastFileHash(oldest)
+        }
+        os.Remove(oldest)
+        for n := keep - 1; n >= 1; n-- {
+            os.Rename(fmt.Sprintf("%s.%d%s", path, n, suffix), fmt.Sprintf("%s.%d%s", path, n+1, suffix))
+        }
+    }
+
+    rotated := path + ".1"
+    if err := os.Rename(path, rotated); err != nil {
+        return pruned, err
+    }
+    if !getBoolSetting("log.compress", true) {
+        return pruned, nil
+    }
+    if err := compressFile(rotated, rotated+".gz"); err != nil {
+        return pruned, err
+    }
+    return pruned, os.Remove(rotated)
+}
+
+func compressFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    gz := gzip.NewWriter(out)
+    if _, err := io.Copy(gz, in); err != nil {
+        out.Close()
+        return err
+    }
+    if err := gz.Close(); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// firstLogTime returns the time of the first event in a log file.
+func firstLogTime(path string) (time.Time, bool) {
+    file, err := os.Open(path)
+    if err != nil {
+        return time.Time{}, false
+    }
+    defer file.Close()
+    line, err := bufio.NewReader(file).ReadString('\n')
+    if err != nil && line == "" {
+        return time.Time{}, false
+    }
+    entry, ok := parseLogLine(line)
+    return entry.Time, ok
+}
+
+// parseLogLine reads a line of baby.log in either format. Text lines only
+// have the time, event, user, IP and details.
+func parseLogLine(line string) (logEntry, bool) {
+    line = strings.TrimSpace(line)
+    var e logEntry
+    if strings.HasPrefix(line, "{") {
+        if err := json.Unmarshal([]byte(line), &e); err != nil || e.Event == "" {
+            return e, false
+        }
+        return e, true
+    }
+
+    // [2006-01-02 15:04:05] EVENT user at ip | details
+    end := strings.Index(line, "] ")
+    if !strings.HasPrefix(line, "[") || end < 0 {
+        return e, false
+    }
+    t, err := time.ParseInLocation(logTimeFormat, line[1:end], time.Local)
+    if err != nil {
+        return e, false
+    }
+    e.Time = t
+    head, details, _ := strings.Cut(line[end+2:], " | ")
+    e.Details = details
+    fields := strings.Fields(head)
+    if len(fields) > 0 {
+        e.Event = fields[0]
+    }
+    if len(fields) >= 4 && fields[len(fields)-2] == "at" {
+        e.User = strings.Join(fields[1:len(fields)-2], " ")
+        e.IP = fields[len(fields)-1]
+    }
+    // Most details start with the name of the rule
+    if strings.HasPrefix(details, "Name: ") {
+        e.Rule, _, _ = strings.Cut(strings.TrimPrefix(details, "Name: "), ",")
+    }
+    if strings.Contains(details, "Result: Success") {
+        e.Result = "success"
+    } else if strings.Contains(details, "Result: Error") {
+        e.Result = "failed"
+    }
+    return e, e.Event != ""
+}
+
+var (
+    cachedIP string
+    ipOnce   sync.Once
+)
+
+// getIP returns the first IPv4 address of the machine that isn't a
+// loopback one. The interfaces are only read once per process.
+func getIP() string {
+    ipOnce.Do(func() {
+        cachedIP = "Unknown IP"
+        addrs, err := net.InterfaceAddrs()
+        if err != nil {
+            return
+        }
+        for _, addr := range addrs {
+            if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+                if ipnet.IP.To4() != nil {
+                    cachedIP = ipnet.IP.String()
+                    return
+                }
+            }
+        }
+    })
+    return cachedIP
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+const (
+    historyFileName = "history.jsonl"
+    // Default number of runs kept in the history
+    defaultHistoryKeep = 1000
+    maskedValue        = "****"
+)
+
+// secretBottleRegexp matches the names of bottles that hold secrets. Their
+// values are masked in the history and never stored, so a rerun asks for
+// them again.
+var secretBottleRegexp = regexp.MustCompile(`(?i)pass|secret|token|key|pwd|credential`)
+
+// HistoryEntry is a run of baby, one line of history.jsonl in the data
+// directory.
+type HistoryEntry struct {
+    ID          string                       `json:"id"`
+    Time        time.Time                    `json:"time"`
+    Rules       []string                     `json:"rules"`
+    // Build is set when the rules were run with baby build
+    Build       bool                         `json:"build,omitempty"`
+    Bottles     map[string]string            `json:"bottles,omitempty"`
+    // RuleBottles are the values answered for a single rule of the run
+    RuleBottles map[string]map[string]string `json:"rule_bottles,omitempty"`
+    Cwd         string                       `json:"cwd"`
+    ExitCode    int                          `json:"exit_code"`
+    Duration    float64                      `json:"duration"`
+    Results     []HistoryResult              `json:"results"`
+
+    secrets []string
+    // mu guards Results, the rules of a build finish concurrently
+    mu sync.Mutex
+}
+
+// HistoryResult is the outcome of one rule of a run.
+type HistoryResult struct {
+    Rule     string  `json:"rule"`
+    Command  string  `json:"command,omitempty"`
+    Dir      string  `json:"dir,omitempty"`
+    Status   string  `json:"status"`
+    ExitCode int     `json:"exit_code"`
+    Duration float64 `json:"duration"`
+    Error    string  `json:"error,omitempty"`
+    Usage    *resourceUsage `json:"usage,omitempty"`
+
+    // stderr is only kept for the run reports. merged is set when it
+    // holds the standard output as well, read from a pseudo-terminal.
+    stderr string
+    merged bool
+}
+
+func newHistoryEntry(runID string, rules []string) *HistoryEntry {
+    cwd, _ := os.Getwd()
+    return &HistoryEntry{ID: runID, Time: time.Now(), Rules: rules, Cwd: cwd}
+}
+
+// setBottles records the bottle values of the run, leaving out the
+// secret ones.
+func (h *HistoryEntry) setBottles(bottleValues map[string]string) {
+    h.Bottles = make(map[string]string)
+    h.secrets = nil
+    for name, value := range bottleValues {
+        if secretBottleRegexp.MatchString(name) {
+            if value != "" {
+                h.secrets = append(h.secrets, value)
+            }
+            continue
+        }
+        h.Bottles[name] = value
+    }
+    // Longer secrets first, so a secret containing another is fully masked
+    sort.Slice(h.secrets, func(i, j int) bool { return len(h.secrets[i]) > len(h.secrets[j]) })
+}
+
+// setRuleBottles records the values answered for each rule, after
+// setBottles, leaving out the secret ones like it does.
+func (h *HistoryEntry) setRuleBottles(prepared []*preparedRule) {
+    for _, p := range prepared {
+        for name, value := range p.bottles {
+            if secretBottleRegexp.MatchString(name) {
+                if value != "" {
+                    h.secrets = append(h.secrets, value)
+                }
+                continue
+            }
+            if runValue, ok := h.Bottles[name]; ok && runValue == value {
+                continue
+            }
+            if h.RuleBottles == nil {
+                h.RuleBottles = make(map[string]map[string]string)
+            }
+            if h.RuleBottles[p.rule.Name] == nil {
+                h.RuleBottles[p.rule.Name] = make(map[string]string)
+            }
+            h.RuleBottles[p.rule.Name][name] = value
+        }
+    }
+    sort.Slice(h.secrets, func(i, j int) bool { return len(h.secrets[i]) > len(h.secrets[j]) })
+}
+
+// mask hides the values of the secret bottles in s. The values of the
+// other bottles are left as they are, like in the bottles of the entry.
+func (h *HistoryEntry) mask(s string) string {
+    for _, secret := range h.secrets {
+        s = strings.ReplaceAll(s, secret, maskedValue)
+    }
+    return s
+}
+
+func (h *HistoryEntry) addResult(rule, command, dir, status string, err error, duration time.Duration, usage *resourceUsage) {
+    result := HistoryResult{
+        Rule:     rule,
+        Command:  h.mask(command),
+        Dir:      h.mask(dir),
+        Status:   status,
+        ExitCode: exitCodeOf(err),
+        Duration: duration.Seconds(),
+        Usage:    usage,
+    }
+    if err != nil {
+        result.Error = h.mask(err.Error())
+    }
+    h.mu.Lock()
+    h.Results = append(h.Results, result)
+    h.mu.Unlock()
+}
+
+// setStderr adds the end of the standard error of a rule to its last
+// result, with the secrets masked.
+func (h *HistoryEntry) setStderr(rule string, stderr *tailBuffer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for i := len(h.Results) - 1; i >= 0; i-- {
+        if h.Results[i].Rule == rule {
+            h.Results[i].stderr = h.mask(stderr.String())
+            h.Results[i].merged = stderr.merged
+            return
+        }
+    }
+}
+
+func (h *HistoryEntry) finish(err error) {
+    h.ExitCode = exitCodeOf(err)
+    h.Duration = time.Since(h.Time).Seconds()
+}
+
+func historyPath() (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %v", err)
+    }
+    dir := filepath.Join(homeDir, logDir)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create data directory: %v", err)
+    }
+    return filepath.Join(dir, historyFileName), nil
+}
+
+// saveRun ends a run and records it in the history, the metrics and the
+// reports of --report.
+func saveRun(h *HistoryEntry, err error, reports []runReport) {
+    h.finish(err)
+    if err := appendHistory(h); err != nil {
+        fmt.Printf("Warning: Failed to save the run in the history: %v\n", err)
+    }
+    updateMetrics(h.Results)
+    writeReports(reports, h)
+}
+
+// appendHistory adds a run to the history and drops the oldest runs beyond
+// the history.keep setting.
+func appendHistory(h *HistoryEntry) error {
+    path, err := historyPath()
+    if err != nil {
+        return err
+    }
+    line, err := json.Marshal(h)
+    if err != nil {
+        return err
+    }
+
+    // The history may hold bottle values, so it is only readable by the user
+    file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    // Runs in the background or from the scheduler may finish together
+    if err := unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+        return err
+    }
+    defer unix.Flock(int(file.Fd()), unix.LOCK_UN)
+
+    var lines [][]byte
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for scanner.Scan() {
+        lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    lines = append(lines, line)
+    if keep := getIntSetting("history.keep", defaultHistoryKeep); keep > 0 && len(lines) > keep {
+        lines = lines[len(lines)-keep:]
+    }
+
+    if err := file.Truncate(0); err != nil {
+        return err
+    }
+    if _, err := file.Seek(0, 0); err != nil {
+        return err
+    }
+    writer := bufio.NewWriter(file)
+    for _, l := range lines {
+        writer.Write(l)
+        writer.WriteByte('\n')
+    }
+    return writer.Flush()
+}
+
+// loadHistory returns the recorded runs, oldest first.
+func loadHistory() ([]*HistoryEntry, error) {
+    path, err := historyPath()
+    if err != nil {
+        return nil, err
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer file.Close()
+
+    var entries []*HistoryEntry
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for scanner.Scan() {
+        var entry HistoryEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            continue
+        }
+        entries = append(entries, &entry)
+    }
+    return entries, scanner.Err()
+}
+
+// findHistoryEntry finds a run by its ID. A unique prefix or suffix of the
+// ID is enough, e.g. the random part at the end.
+func findHistoryEntry(entries []*HistoryEntry, id string) (*HistoryEntry, error) {
+    var found []*HistoryEntry
+    for _, entry := range entries {
+        if entry.ID == id {
+            return entry, nil
+        }
+        if strings.HasPrefix(entry.ID, id) || strings.HasSuffix(entry.ID, id) {
+            found = append(found, entry)
+        }
+    }
+    switch len(found) {
+    case 0:
+        return nil, fmt.Errorf("run '%s' not found in the history", id)
+    case 1:
+        return found[0], nil
+    }
+    return nil, fmt.Errorf("'%s' matches %d runs, use a longer ID", id, len(found))
+}
+
+// showHistory prints the last runs.
+func showHistory(last int) {
+    entries, err := loadHistory()
+    if err != nil {
+        fmt.Println("Error reading the history:", err)
+        return
+    }
+    if len(entries) == 0 {
+        fmt.Println("No runs in the history.")
+        return
+    }
+    if last > 0 && len(entries) > last {
+        entries = entries[len(entries)-last:]
+    }
+
+    fmt.Printf("%-29s %-19s %-5s %-10s %s\n", "ID", "STARTED", "EXIT", "DURATION", "RULES")
+    for _, entry := range entries {
+        duration := time.Duration(entry.Duration * float64(time.Second)).Round(time.Millisecond)
+        rules := strings.Join(entry.Rules, " ")
+        if entry.Build {
+            rules = "build " + rules
+        }
+        fmt.Printf("%-29s %-19s %-5d %-10v %s\n", entry.ID, entry.Time.Format("2006-01-02 15:04:05"),
+            entry.ExitCode, duration, rules)
+        for _, result := range entry.Results {
+            line := fmt.Sprintf("    %s: %s", result.Rule, result.Status)
+            if result.Command != "" {
+                line += fmt.Sprintf(", %s", result.Command)
+            }
+            if result.Dir != "" {
+                line += fmt.Sprintf(" (in %s)", result.Dir)
+            }
+            fmt.Println(line)
+        }
+    }
+}
+
+// rerun runs the rules of a past run again with the same bottle values.
+// An empty id reruns the last run. Secret bottles are asked for again.
+func rerun(id string, bottleValues map[string]string, opts runOptions) error {
+    entries, err := loadHistory()
+    if err != nil {
+        fmt.Println("Error reading the history:", err)
+        return err
+    }
+    if len(entries) == 0 {
+        fmt.Println("No runs in the history.")
+        return fmt.Errorf("no runs in the history")
+    }
+
+    entry := entries[len(entries)-1]
+    if id != "" {
+        if entry, err = findHistoryEntry(entries, id); err != nil {
+            fmt.Println("Error:", err)
+            return err
+        }
+    }
+
+    // Bottles given on the command line win over the recorded ones
+    for name, value := range entry.Bottles {
+        if _, ok := bottleValues[name]; !ok {
+            bottleValues[name] = value
+        }
+    }
+    opts.ruleBottles = entry.RuleBottles
+    fmt.Printf("Rerunning %s: %s\n", entry.ID, strings.Join(entry.Rules, " "))
+    if entry.Build {
+        return buildRules(entry.Rules, bottleValues, opts, buildJobs())
+    }
+    return runCommands(entry.Rules, bottleValues, opts)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    hookBefore = "before"
+    hookAfter  = "after"
+)
+
+// hook is a command run around a rule, either one of the rule's own
+// before/after options or an executable of the global hook directory.
+type hook struct {
+    name string
+    cmd  *exec.Cmd
+}
+
+// globalHooksDir returns ~/.config/baby/hooks/<phase>.d, whose executables
+// run around every rule.
+func globalHooksDir(phase string) string {
+    return filepath.Join(filepath.Dir(configFile), "hooks", phase+".d")
+}
+
+// globalHooks lists the executables of a global hook directory in name
+// order. A missing directory simply has no hooks.
+func globalHooks(phase string) []hook {
+    dir := globalHooksDir(phase)
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil
+    }
+
+    var names []string
+    for _, entry := range entries {
+        name := entry.Name()
+        if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+            continue
+        }
+        info, err := os.Stat(filepath.Join(dir, name))
+        if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+            continue
+        }
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var hooks []hook
+    for _, name := range names {
+        hooks = append(hooks, hook{name: filepath.Join(dir, name), cmd: exec.Command(filepath.Join(dir, name))})
+    }
+    return hooks
+}
+
+// runHooks runs the hooks of a phase for a rule. Global before hooks run
+// ahead of the rule's own, and global after hooks behind them. The hooks
+// get the rule's directory and environment plus BABY_RULE, BABY_COMMAND
+// and, after the rule, BABY_EXIT_CODE and BABY_DURATION in seconds.
+//
+// The first failing before hook stops the others and is returned. Failing
+// after hooks are only reported.
+func runHooks(phase string, p *preparedRule, result error, duration time.Duration) error {
+    var hooks []hook
+    commands := p.before
+    if phase == hookAfter {
+        commands = p.after
+    }
+    for _, command := range commands {
+        hooks = append(hooks, hook{name: command, cmd: exec.Command("bash", "-c", command)})
+    }
+    if phase == hookBefore {
+        hooks = append(globalHooks(phase), hooks...)
+    } else {
+        hooks = append(hooks, globalHooks(phase)...)
+    }
+    if len(hooks) == 0 {
+        return nil
+    }
+    if p.sandbox {
+        // Hooks run outside of the rule, they would escape the sandbox
+        fmt.Printf("Sandbox: skipping %d %s hook(s)\n", len(hooks), phase)
+        return nil
+    }
+
+    env := p.env
+    if env == nil {
+        env = os.Environ()
+    }
+    env = append(env,
+        "BABY_HOOK="+phase,
+        "BABY_RULE="+p.rule.Name,
+        "BABY_COMMAND="+p.command,
+    )
+    if phase == hookAfter {
+        env = append(env,
+            "BABY_EXIT_CODE="+strconv.Itoa(exitCodeOf(result)),
+            "BABY_DURATION="+strconv.FormatFloat(duration.Seconds(), 'f', 3, 64),
+        )
+    }
+
+    for _, h := range hooks {
+        h.cmd.Dir = p.dir
+        h.cmd.Env = env
+        h.cmd.Stdout = os.Stdout
+        h.cmd.Stderr = os.Stderr
+
+        err := h.cmd.Run()
+        if err == nil {
+            continue
+        }
+
+        logWarning(writeLog(logEntry{Event: "HOOK_FAILED", Rule: p.rule.Name, Result: "failed",
+            Details: fmt.Sprintf("Name: %s, Hook: %s \"%s\", Result: Error: %v", p.rule.Name, phase, h.name, err)}))
+        if phase == hookBefore {
+            return fmt.Errorf("before hook '%s' failed: %v", h.name, err)
+        }
+        fmt.Printf("Warning: after hook '%s' failed: %v\n", h.name, err)
+    }
+    return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// Job is a background run started with --bg. It is stored as
+// jobs/<id>.json in the state directory, next to its output in
+// jobs/<id>.out.
+type Job struct {
+    ID          int                          `json:"id"`
+    Rules       []string                     `json:"rules"`
+    Bottles     map[string]string            `json:"bottles,omitempty"`
+    // RuleBottles are the values answered for each rule before it started
+    RuleBottles map[string]map[string]string `json:"rule_bottles,omitempty"`
+    Timeout     time.Duration                `json:"timeout,omitempty"`
+    // Confirmed is set once the rules that need it were confirmed
+    Confirmed   bool                         `json:"confirmed,omitempty"`
+    PID         int                          `json:"pid,omitempty"`
+    Output      string                       `json:"output"`
+    Started     time.Time                    `json:"started"`
+    Finished    time.Time                    `json:"finished,omitempty"`
+    ExitCode    int                          `json:"exit_code"`
+}
+
+// status describes the job for baby jobs.
+func (j *Job) status() string {
+    if !j.Finished.IsZero() {
+        if j.ExitCode == 0 {
+            return "done"
+        }
+        return "failed"
+    }
+    if j.PID == 0 {
+        return "starting"
+    }
+    if unix.Kill(j.PID, 0) != nil {
+        return "lost"
+    }
+    return "running"
+}
+
+func jobsDir() (string, error) {
+    return babyStateDir("jobs")
+}
+
+func jobPath(dir string, id int) string {
+    return filepath.Join(dir, fmt.Sprintf("%d.json", id))
+}
+
+func loadJob(id int) (*Job, error) {
+    dir, err := jobsDir()
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(jobPath(dir, id))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, fmt.Errorf("job %d not found", id)
+        }
+        return nil, fmt.Errorf("failed to read job %d: %v", id, err)
+    }
+    var job Job
+    if err := json.Unmarshal(data, &job); err != nil {
+        return nil, fmt.Errorf("failed to read job %d: %v", id, err)
+    }
+    return &job, nil
+}
+
+func loadJobs() ([]*Job, error) {
+    dir, err := jobsDir()
+    if err != nil {
+        return nil, err
+    }
+    paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+
+    var jobs []*Job
+    for _, path := range paths {
+        id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json"))
+        if err != nil {
+            continue
+        }
+        // newJobID claims the number with an empty file, the record comes
+        // right after
+        if info, err := os.Stat(path); err == nil && info.Size() == 0 {
+            continue
+        }
+        job, err := loadJob(id)
+        if err != nil {
+            fmt.Printf("Warning: %v\n", err)
+            continue
+        }
+        jobs = append(jobs, job)
+    }
+    sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+    return jobs, nil
+}
+
+// saveJob writes the job record. The record may hold bottle values, so it
+// is only readable by the user.
+func saveJob(job *Job) error {
+    dir, err := jobsDir()
+    if err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(job, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := jobPath(dir, job.ID) + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return fmt.Errorf("failed to write job %d: %v", job.ID, err)
+    }
+    return os.Rename(tmp, jobPath(dir, job.ID))
+}
+
+// newJobID claims the next free job number.
+func newJobID(dir string) (int, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return 0, err
+    }
+    id := 1
+    for _, path := range paths {
+        if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json")); err == nil && n >= id {
+            id = n + 1
+        }
+    }
+    for ; ; id++ {
+        // O_EXCL keeps two baby processes from taking the same number
+        file, err := os.OpenFile(jobPath(dir, id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+        if err == nil {
+            file.Close()
+            return id, nil
+        }
+        if !os.IsExist(err) {
+            return 0, fmt.Errorf("failed to create job: %v", err)
+        }
+    }
+}
+
+// startBackgroundJob asks for the bottles and confirmations of the rules
+// while the terminal is still attached, then starts a detached baby
+// process that runs them and records the result.
+func startBackgroundJob(commands []string, bottleValues map[string]string, opts runOptions) {
+    ruleBottles := make(map[string]map[string]string)
+    for _, name := range commands {
+        rule, err := loadRule(name)
+        if err != nil {
+            fmt.Printf("Error: %s\n", err)
+            return
+        }
+        p, err := prepareRule(rule, bottleValues, opts)
+        if err != nil {
+            fmt.Printf("Error: %s\n", err)
+            return
+        }
+        if !confirmRule(p, opts) {
+            fmt.Println("Operation cancelled.")
+            return
+        }
+        ruleBottles[name] = p.bottles
+    }
+
+    dir, err := jobsDir()
+    if err != nil {
+        fmt.Println("Error creating the jobs directory:", err)
+        return
+    }
+    id, err := newJobID(dir)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    job := &Job{
+        ID:          id,
+        Rules:       commands,
+        Bottles:     bottleValues,
+        RuleBottles: ruleBottles,
+        Timeout:     opts.timeout,
+        Confirmed:   true,
+        Output:      filepath.Join(dir, fmt.Sprintf("%d.out", id)),
+        Started:     time.Now(),
+    }
+    if err := saveJob(job); err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    output, err := os.OpenFile(job.Output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        fmt.Println("Error creating the job output file:", err)
+        return
+    }
+    defer output.Close()
+
+    executable, err := os.Executable()
+    if err != nil {
+        fmt.Println("Error finding the baby executable:", err)
+        return
+    }
+    cmd := exec.Command(executable, "__job", strconv.Itoa(id))
+    cmd.Stdout = output
+    cmd.Stderr = output
+    // A new session detaches the job from the terminal and its signals
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+    if err := cmd.Start(); err != nil {
+        fmt.Println("Error starting the job:", err)
+        return
+    }
+    pid := cmd.Process.Pid
+    cmd.Process.Release()
+
+    logWarning(logEvent("START_JOB", fmt.Sprintf("Job: %d, Rules: %s, PID: %d", id, strings.Join(commands, " "), pid)))
+
+    fmt.Printf("Job %d started in the background (PID %d).\n", id, pid)
+    fmt.Printf("Use 'baby logs %d' to see its output.\n", id)
+}
+
+// runJob is the detached side of startBackgroundJob.
+func runJob(id int) {
+    job, err := loadJob(id)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    job.PID = os.Getpid()
+    if err := saveJob(job); err != nil {
+        fmt.Println("Error:", err)
+    }
+
+    // baby kill may come between two rules, the job still has to stop
+    // and record how it ended
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    defer signal.Stop(signals)
+    err = runCommands(job.Rules, job.Bottles, runOptions{timeout: job.Timeout, noPrompt: true, yes: job.Confirmed,
+        ruleBottles: job.RuleBottles, stop: signals})
+
+    job.Finished = time.Now()
+    job.ExitCode = exitCodeOf(err)
+    // The bottles are no longer needed once the job is over
+    job.Bottles = nil
+    job.RuleBottles = nil
+    if err := saveJob(job); err != nil {
+        fmt.Println("Error:", err)
+    }
+    duration := job.Finished.Sub(job.Started).Seconds()
+    result := "success"
+    if job.ExitCode != 0 {
+        result = "failed"
+    }
+    logWarning(writeLog(logEntry{Event: "FINISH_JOB", ExitCode: &job.ExitCode, Duration: &duration, Result: result,
+        Details: fmt.Sprintf("Job: %d, Exit code: %d in %v", id, job.ExitCode, job.Finished.Sub(job.Started))}))
+}
+
+func listJobs() {
+    jobs, err := loadJobs()
+    if err != nil {
+        fmt.Println("Error reading jobs:", err)
+        return
+    }
+    if len(jobs) == 0 {
+        fmt.Println("No background jobs.")
+        return
+    }
+
+    fmt.Printf("%-4s %-9s %-5s %-19s %-10s %s\n", "ID", "STATUS", "EXIT", "STARTED", "DURATION", "RULES")
+    for _, job := range jobs {
+        status := job.status()
+        exitCode := "-"
+        end := time.Now()
+        if !job.Finished.IsZero() {
+            exitCode = strconv.Itoa(job.ExitCode)
+            end = job.Finished
+        }
+        duration := end.Sub(job.Started).Round(time.Second)
+        fmt.Printf("%-4d %-9s %-5s %-19s %-10v %s\n", job.ID, status, exitCode,
+            job.Started.Format("2006-01-02 15:04:05"), duration, strings.Join(job.Rules, " "))
+    }
+}
+
+// clearJobs removes the records and output of the jobs that are no longer
+// running.
+func clearJobs() {
+    jobs, err := loadJobs()
+    if err != nil {
+        fmt.Println("Error reading jobs:", err)
+        return
+    }
+    dir, err := jobsDir()
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    removed := 0
+    for _, job := range jobs {
+        status := job.status()
+        if status == "running" || status == "starting" {
+            continue
+        }
+        os.Remove(job.Output)
+        os.Remove(jobPath(dir, job.ID))
+        removed++
+    }
+    fmt.Printf("%d finished job(s) removed.\n", removed)
+}
+
+// showJobLogs prints the last lines of a job's output. With follow it
+// keeps printing new output until the job finishes.
+func showJobLogs(id int, lines int, follow bool) {
+    job, err := loadJob(id)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    file, err := os.Open(job.Output)
+    if err != nil {
+        fmt.Println("Error opening the job output:", err)
+        return
+    }
+    defer file.Close()
+
+    content, err := io.ReadAll(file)
+    if err != nil {
+        fmt.Println("Error reading the job output:", err)
+        return
+    }
+    os.Stdout.Write(tailLines(content, lines))
+
+    if !follow {
+        return
+    }
+    buf := make([]byte, 32*1024)
+    for {
+        n, err := file.Read(buf)
+        if n > 0 {
+            os.Stdout.Write(buf[:n])
+            continue
+        }
+        if err != nil && err != io.EOF {
+            fmt.Println("Error reading the job output:", err)
+            return
+        }
+        if job, err = loadJob(id); err != nil || job.status() != "running" && job.status() != "starting" {
+            return
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+}
+
+// tailLines returns the last n lines of content, or all of it when n is
+// zero or negative.
+func tailLines(content []byte, n int) []byte {
+    if n <= 0 {
+        return content
+    }
+    end := len(content)
+    if end > 0 && content[end-1] == '\n' {
+        end--
+    }
+    for i := end - 1; i >= 0; i-- {
+        if content[i] == '\n' {
+            n--
+            if n == 0 {
+                return content[i+1:]
+            }
+        }
+    }
+    return content
+}
+
+// killJob stops a running job. The job's baby process forwards the signal
+// to the rule's process group and kills it if it doesn't exit in time.
+func killJob(id int) {
+    job, err := loadJob(id)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    if job.status() != "running" {
+        fmt.Printf("Job %d is not running.\n", id)
+        return
+    }
+
+    if err := unix.Kill(job.PID, unix.SIGTERM); err != nil {
+        fmt.Printf("Error stopping job %d: %v\n", id, err)
+        return
+    }
+    logWarning(logEvent("KILL_JOB", fmt.Sprintf("Job: %d, PID: %d", id, job.PID)))
+    fmt.Printf("Stopping job %d.\n", id)
+}
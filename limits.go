@@ -0,0 +1,376 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// rlimitKeys maps the limit options of a rule to the resource limited
+// with setrlimit.
+var rlimitKeys = []struct {
+    key      string
+    resource int
+}{
+    {"limit-cpu", unix.RLIMIT_CPU},
+    {"limit-as", unix.RLIMIT_AS},
+    {"limit-files", unix.RLIMIT_NOFILE},
+    {"limit-procs", unix.RLIMIT_NPROC},
+}
+
+// ruleLimits are the resource limits of a prepared rule. The rlimits are
+// set by the process that becomes bash, so they apply to the command and
+// everything it starts. The cgroup quotas apply to all of them together.
+type ruleLimits struct {
+    rlimits map[int]uint64
+    cpu     time.Duration
+    // memoryMax is the cgroup memory.max in bytes and cpuQuota the share
+    // of one CPU in percent
+    memoryMax int64
+    cpuQuota  int
+}
+
+func (l *ruleLimits) empty() bool {
+    return len(l.rlimits) == 0 && l.memoryMax == 0 && l.cpuQuota == 0
+}
+
+// parseSize reads a size like 512M or 2G in bytes.
+func parseSize(value string) (int64, error) {
+    units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+    number, multiplier := strings.ToUpper(strings.TrimSpace(value)), int64(1)
+    number = strings.TrimSuffix(number, "B")
+    if n := len(number); n > 0 {
+        if unit, ok := units[number[n-1]]; ok {
+            number, multiplier = number[:n-1], unit
+        }
+    }
+    size, err := strconv.ParseInt(number, 10, 64)
+    if err != nil || size <= 0 {
+        return 0, fmt.Errorf("'%s' is not a size, e.g. 512M or 2G", value)
+    }
+    return size * multiplier, nil
+}
+
+// parseCPUQuota reads a CPU quota like 50% or 1.5 (CPUs) in percent of
+// one CPU.
+func parseCPUQuota(value string) (int, error) {
+    value = strings.TrimSpace(value)
+    percent := strings.HasSuffix(value, "%")
+    n, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+    if err != nil || n <= 0 {
+        return 0, fmt.Errorf("'%s' is not a CPU quota, e.g. 50%% or 2", value)
+    }
+    if !percent {
+        n *= 100
+    }
+    return int(n), nil
+}
+
+// validateLimit checks the value of a limit option.
+func validateLimit(key, value string) error {
+    switch key {
+    case "limit-cpu":
+        if d, err := time.ParseDuration(value); err != nil || d < time.Second {
+            return fmt.Errorf("'%s' is not a duration of at least one second, e.g. 90s", value)
+        }
+    case "limit-as", "cgroup-memory":
+        _, err := parseSize(value)
+        return err
+    case "limit-files", "limit-procs":
+        if n, err := strconv.Atoi(value); err != nil || n < 1 {
+            return fmt.Errorf("'%s' is not a positive number", value)
+        }
+    case "cgroup-cpu":
+        _, err := parseCPUQuota(value)
+        return err
+    }
+    return nil
+}
+
+// parseRuleLimits reads the limit options of a rule.
+func parseRuleLimits(rule *Rule) (ruleLimits, error) {
+    limits := ruleLimits{rlimits: make(map[int]uint64)}
+    for _, rl := range rlimitKeys {
+        value := rule.option(rl.key)
+        if value == "" {
+            continue
+        }
+        if err := validateLimit(rl.key, value); err != nil {
+            return limits, fmt.Errorf("invalid %s in rule '%s': %v", rl.key, rule.Name, err)
+        }
+        switch rl.key {
+        case "limit-cpu":
+            limits.cpu, _ = time.ParseDuration(value)
+            limits.rlimits[rl.resource] = uint64(limits.cpu / time.Second)
+        case "limit-as":
+            size, _ := parseSize(value)
+            limits.rlimits[rl.resource] = uint64(size)
+        default:
+            n, _ := strconv.Atoi(value)
+            limits.rlimits[rl.resource] = uint64(n)
+        }
+    }
+    if value := rule.option("cgroup-memory"); value != "" {
+        size, err := parseSize(value)
+        if err != nil {
+            return limits, fmt.Errorf("invalid cgroup-memory in rule '%s': %v", rule.Name, err)
+        }
+        limits.memoryMax = size
+    }
+    if value := rule.option("cgroup-cpu"); value != "" {
+        quota, err := parseCPUQuota(value)
+        if err != nil {
+            return limits, fmt.Errorf("invalid cgroup-cpu in rule '%s': %v", rule.Name, err)
+        }
+        limits.cpuQuota = quota
+    }
+    return limits, nil
+}
+
+// limitError is returned by executeCommand when a rule was stopped for
+// going over one of its limits.
+type limitError struct {
+    limit string
+    err   error
+}
+
+func (e *limitError) Error() string {
+    return fmt.Sprintf("%s exceeded: %v", e.limit, e.err)
+}
+
+// transientCgroup is the cgroup v2 group created for a single execution.
+type transientCgroup struct {
+    path string
+}
+
+var cgroupWarning sync.Once
+
+// cgroupV2Mount returns where the cgroup v2 hierarchy is mounted.
+func cgroupV2Mount() string {
+    lines, err := readLines("/proc/self/mountinfo")
+    if err != nil {
+        return ""
+    }
+    for _, line := range lines {
+        // The file system type follows the " - " separator
+        parts := strings.SplitN(line, " - ", 2)
+        fields := strings.Fields(parts[0])
+        if len(parts) == 2 && strings.HasPrefix(parts[1], "cgroup2 ") && len(fields) > 4 {
+            return fields[4]
+        }
+    }
+    return ""
+}
+
+// delegatedCgroupParent returns the cgroup under which baby may create
+// groups: the parent of its own cgroup, when the user owns it and the
+// memory and cpu controllers are enabled for its children.
+func delegatedCgroupParent() (string, error) {
+    mount := cgroupV2Mount()
+    if mount == "" {
+        return "", fmt.Errorf("cgroup v2 is not mounted")
+    }
+    lines, err := readLines("/proc/self/cgroup")
+    if err != nil {
+        return "", err
+    }
+    var own string
+    for _, line := range lines {
+        if strings.HasPrefix(line, "0::") {
+            own = strings.TrimPrefix(line, "0::")
+        }
+    }
+    if own == "" {
+        return "", fmt.Errorf("baby is not in a cgroup v2 group")
+    }
+
+    // A group with processes can't have child groups with controllers, so
+    // the new group goes next to baby's own
+    parent := filepath.Join(mount, filepath.Dir(own))
+    for _, name := range []string{"", "cgroup.procs", "cgroup.subtree_control"} {
+        if unix.Access(filepath.Join(parent, name), unix.W_OK) != nil {
+            return "", fmt.Errorf("cgroup %s is not delegated to this user", parent)
+        }
+    }
+    controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+    if err != nil {
+        return "", err
+    }
+    for _, controller := range []string{"memory", "cpu"} {
+        if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+controller+" ") {
+            return "", fmt.Errorf("the %s controller is not enabled in %s", controller, parent)
+        }
+    }
+    return parent, nil
+}
+
+// createCgroup creates the transient group of an execution with the
+// quotas of the rule.
+func createCgroup(limits *ruleLimits) (*transientCgroup, error) {
+    parent, err := delegatedCgroupParent()
+    if err != nil {
+        return nil, err
+    }
+    path := filepath.Join(parent, fmt.Sprintf("baby-%d-%d", os.Getpid(), time.Now().UnixNano()))
+    if err := os.Mkdir(path, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create cgroup: %v", err)
+    }
+    cg := &transientCgroup{path: path}
+    if limits.memoryMax > 0 {
+        if err := os.WriteFile(filepath.Join(path, "memory.max"), []byte(strconv.FormatInt(limits.memoryMax, 10)), 0644); err != nil {
+            cg.remove()
+            return nil, fmt.Errorf("failed to set memory.max: %v", err)
+        }
+        // Without swap the memory limit is a hard one
+        os.WriteFile(filepath.Join(path, "memory.swap.max"), []byte("0"), 0644)
+    }
+    if limits.cpuQuota > 0 {
+        const period = 100000
+        quota := fmt.Sprintf("%d %d", limits.cpuQuota*period/100, period)
+        if err := os.WriteFile(filepath.Join(path, "cpu.max"), []byte(quota), 0644); err != nil {
+            cg.remove()
+            return nil, fmt.Errorf("failed to set cpu.max: %v", err)
+        }
+    }
+    return cg, nil
+}
+
+// oomKilled reports whether the kernel killed a process of the group for
+// going over memory.max.
+func (cg *transientCgroup) oomKilled() bool {
+    lines, err := readLines(filepath.Join(cg.path, "memory.events"))
+    if err != nil {
+        return false
+    }
+    for _, line := range lines {
+        fields := strings.Fields(line)
+        if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+            return true
+        }
+    }
+    return false
+}
+
+func (cg *transientCgroup) remove() {
+    // The group can only be removed once its processes are gone
+    for i := 0; i < 10; i++ {
+        if err := os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+            return
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
+
+// limitedCommand returns the command of a rule with limits. baby runs
+// itself as "baby __exec", which joins the cgroup and sets the rlimits
+// before it becomes bash, so nothing of the rule runs without them.
+func limitedCommand(p *preparedRule) (*exec.Cmd, *transientCgroup, error) {
+    executable, err := os.Executable()
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to find the baby executable: %v", err)
+    }
+
+    var cg *transientCgroup
+    if p.limits.memoryMax > 0 || p.limits.cpuQuota > 0 {
+        if cg, err = createCgroup(&p.limits); err != nil {
+            cgroupWarning.Do(func() {
+                fmt.Printf("Warning: The cgroup quotas of rule '%s' are not applied: %v\n", p.rule.Name, err)
+            })
+        }
+    }
+    cgroupPath := "-"
+    if cg != nil {
+        cgroupPath = cg.path
+    }
+
+    var specs []string
+    for resource, value := range p.limits.rlimits {
+        specs = append(specs, fmt.Sprintf("%d=%d", resource, value))
+    }
+    spec := strings.Join(specs, ",")
+    if spec == "" {
+        spec = "-"
+    }
+    return exec.Command(executable, "__exec", spec, cgroupPath, p.command), cg, nil
+}
+
+// undetectedLimits returns the limits of a rule whose breach can't be
+// told apart from another failure: the kernel makes a system call fail
+// and the command decides what to do with the error.
+func undetectedLimits(rule *Rule) []string {
+    var limits []string
+    for _, key := range []string{"limit-as", "limit-files", "limit-procs"} {
+        if value := rule.option(key); value != "" {
+            limits = append(limits, key+" "+value)
+        }
+    }
+    return limits
+}
+
+// limitBreach tells whether a failed execution was stopped by one of the
+// limits of the rule.
+func limitBreach(p *preparedRule, cg *transientCgroup, state *os.ProcessState, err error) error {
+    if err == nil {
+        return nil
+    }
+    if cg != nil && cg.oomKilled() {
+        return &limitError{limit: fmt.Sprintf("memory limit of %s", formatKilobytes(p.limits.memoryMax/1024)), err: err}
+    }
+    if p.limits.cpu > 0 && state != nil {
+        // The kernel sends SIGXCPU at the limit and SIGKILL a second later
+        if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() &&
+            (status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGKILL) &&
+            state.UserTime()+state.SystemTime() >= p.limits.cpu {
+            return &limitError{limit: fmt.Sprintf("CPU time limit of %v", p.limits.cpu), err: err}
+        }
+    }
+    return err
+}
+
+// execLimited is the "baby __exec" side of limitedCommand: it applies the
+// limits to itself and replaces itself with bash.
+func execLimited(spec, cgroupPath, command string) {
+    if cgroupPath != "-" {
+        if err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte("0"), 0644); err != nil {
+            fmt.Fprintf(os.Stderr, "baby: failed to join cgroup: %v\n", err)
+            os.Exit(126)
+        }
+    }
+    if spec != "-" {
+        for _, item := range strings.Split(spec, ",") {
+            var resource int
+            var value uint64
+            if _, err := fmt.Sscanf(item, "%d=%d", &resource, &value); err != nil {
+                fmt.Fprintf(os.Stderr, "baby: invalid limit %s\n", item)
+                os.Exit(126)
+            }
+            limit := unix.Rlimit{Cur: value, Max: value}
+            if resource == unix.RLIMIT_CPU {
+                // One more second before SIGKILL, so the command gets
+                // SIGXCPU first and may clean up
+                limit.Max = value + 1
+            }
+            if err := unix.Setrlimit(resource, &limit); err != nil {
+                fmt.Fprintf(os.Stderr, "baby: failed to set limit %s: %v\n", item, err)
+                os.Exit(126)
+            }
+        }
+    }
+
+    bash, err := exec.LookPath("bash")
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "baby: %v\n", err)
+        os.Exit(127)
+    }
+    err = unix.Exec(bash, []string{"bash", "-c", command}, os.Environ())
+    fmt.Fprintf(os.Stderr, "baby: failed to execute bash: %v\n", err)
+    os.Exit(126)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// A chained event ends with its own hash, see chainLine.
+var hashSuffixRegexp = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+
+// logHasher returns SHA-256, or HMAC-SHA256 when log.hmac-key-file names
+// a key. Without the key a chain can be rewritten from the edited event
+// on, with it only the key's owner can.
+func logHasher() (hash.Hash, error) {
+    keyFile := getSetting("log.hmac-key-file", "")
+    if keyFile == "" {
+        return sha256.New(), nil
+    }
+    key, err := os.ReadFile(expandHome(keyFile))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read log.hmac-key-file: %v", err)
+    }
+    key = bytes.TrimSpace(key)
+    if len(key) == 0 {
+        return nil, fmt.Errorf("log.hmac-key-file %s is empty", keyFile)
+    }
+    return hmac.New(sha256.New, key), nil
+}
+
+// chainLine adds the hash of a JSON event to it. The hash covers the line
+// as written, prev included, so any change to it breaks the chain.
+func chainLine(data []byte) ([]byte, error) {
+    h, err := logHasher()
+    if err != nil {
+        return nil, err
+    }
+    h.Write(data)
+    line := append([]byte(nil), data[:len(data)-1]...)
+    return append(line, fmt.Sprintf(`,"hash":"%x"}`, h.Sum(nil))...), nil
+}
+
+// lineHash checks the hash at the end of a chained line. It returns the
+// hash, whether the line is chained and whether the hash matches.
+func lineHash(h hash.Hash, line string) (string, bool, bool) {
+    m := hashSuffixRegexp.FindStringSubmatchIndex(line)
+    if m == nil {
+        return "", false, false
+    }
+    sum := line[m[2]:m[3]]
+    h.Reset()
+    io.WriteString(h, line[:m[0]]+"}")
+    want, _ := hex.DecodeString(sum)
+    return sum, true, hmac.Equal(h.Sum(nil), want)
+}
+
+// lastLogHash returns the hash of the last event of the log, which the
+// next event links to. An empty log continues the newest rotated one.
+func lastLogHash(path string) string {
+    if line := lastLine(path); line != "" {
+        return hashOf(line)
+    }
+    rotated := rotatedLogs(path)
+    if len(rotated) == 0 {
+        return ""
+    }
+    return lastFileHash(rotated[len(rotated)-1])
+}
+
+// lastFileHash returns the hash of the last event of a log file, which
+// may be compressed.
+func lastFileHash(path string) string {
+    last := ""
+    readLogFile(path, func(e logEntry) { last = e.Hash })
+    return last
+}
+
+func hashOf(line string) string {
+    if m := hashSuffixRegexp.FindStringSubmatch(line); m != nil {
+        return m[1]
+    }
+    return ""
+}
+
+// lastLine reads the last line of a file from its end.
+func lastLine(path string) string {
+    file, err := os.Open(path)
+    if err != nil {
+        return ""
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil || info.Size() == 0 {
+        return ""
+    }
+    for size := int64(64 * 1024); ; size *= 4 {
+        if size > info.Size() {
+            size = info.Size()
+        }
+        buf := make([]byte, size)
+        if _, err := file.ReadAt(buf, info.Size()-size); err != nil && err != io.EOF {
+            return ""
+        }
+        buf = bytes.TrimRight(buf, "\n")
+        if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+            return string(buf[i+1:])
+        }
+        if size == info.Size() {
+            return string(buf)
+        }
+    }
+}
+
+// verifyLogFiles returns the log files to verify from the oldest to the
+// newest. Unlike rotatedLogs it doesn't stop at a missing file, a gap is
+// a broken chain.
+func verifyLogFiles(path string) ([]string, error) {
+    matches, _ := filepath.Glob(path + ".*")
+    byNumber := make(map[int]string)
+    var numbers []int
+    for _, match := range matches {
+        suffix := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+        n, err := strconv.Atoi(suffix)
+        if err != nil || n < 1 {
+            continue
+        }
+        if _, ok := byNumber[n]; !ok {
+            numbers = append(numbers, n)
+        }
+        // Prefer the compressed file, like rotatedLogs
+        if _, ok := byNumber[n]; !ok || strings.HasSuffix(match, ".gz") {
+            byNumber[n] = match
+        }
+    }
+    sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+    var files []string
+    for i, n := range numbers {
+        if i > 0 && numbers[i-1] != n+1 {
+            return nil, fmt.Errorf("%s.%d is missing", path, n+1)
+        }
+        if i == len(numbers)-1 && n != 1 {
+            return nil, fmt.Errorf("%s.1 is missing", path)
+        }
+        files = append(files, byNumber[n])
+    }
+    if _, err := os.Stat(path); err == nil {
+        files = append(files, path)
+    }
+    return files, nil
+}
+
+// verifyLog walks the chain of baby.log and its rotated files and reports
+// the first event that was removed, reordered, modified or added by hand.
+// Events written before the chain started aren't covered. A chain that
+// starts in the middle is only intact when a LOG_PRUNED event says the
+// file before it was removed by the rotation.
+func verifyLog() error {
+    path := logPath()
+    if getSetting("log.format", "json") == "text" {
+        fmt.Println("Warning: log.format is text, the events written from now on aren't chained and break the chain.")
+    }
+    files, err := verifyLogFiles(path)
+    if err != nil {
+        return fmt.Errorf("the chain is broken: %v", err)
+    }
+    h, err := logHasher()
+    if err != nil {
+        return err
+    }
+
+    var previous, brokenAt, firstAt string
+    var unchained, chained int
+    var first logEntry
+    pruned := make(map[string]bool)
+    for _, file := range files {
+        number := 0
+        readErr := readLogLines(file, func(line string) bool {
+            number++
+            where := fmt.Sprintf("line %d of %s", number, filepath.Base(file))
+            sum, ok, valid := lineHash(h, line)
+            if !ok {
+                if chained == 0 {
+                    unchained++
+                    return true
+                }
+                brokenAt = where + ": the event isn't chained, it was added or its hash removed"
+                if !strings.HasPrefix(line, "{") {
+                    brokenAt = where + ": the event isn't chained, it was added or written with log.format = text"
+                }
+                return false
+            }
+            e, parsed := parseLogLine(line)
+            if !valid || !parsed {
+                brokenAt = where + ": the event was modified"
+                if chained == 0 && getSetting("log.hmac-key-file", "") != "" {
+                    brokenAt += " or the log wasn't written with this HMAC key"
+                }
+                return false
+            }
+            if chained > 0 && e.Prev != previous {
+                brokenAt = where + ": the event before it was removed or the events were reordered"
+                return false
+            }
+            if chained == 0 {
+                first, firstAt = e, where
+            }
+            if e.Event == "LOG_PRUNED" && e.Pruned != "" {
+                pruned[e.Pruned] = true
+            }
+            chained++
+            previous = sum
+            return true
+        })
+        if readErr != nil {
+            return fmt.Errorf("failed to read %s: %v", file, readErr)
+        }
+        if brokenAt != "" {
+            return fmt.Errorf("the chain is broken at %s", brokenAt)
+        }
+    }
+
+    if chained == 0 {
+        fmt.Println("No chained events in the log.")
+        return nil
+    }
+    // The first event links to one that isn't there, only the rotation
+    // may have removed it
+    if first.Prev != "" && !pruned[first.Prev] {
+        return fmt.Errorf("the chain is broken at %s: the events before it were removed", firstAt)
+    }
+    fmt.Printf("The chain is intact: %d events in %d file(s) since %s.\n", chained, len(files), first.Time.Local().Format(logTimeFormat))
+    if first.Prev != "" {
+        fmt.Println("It continues an older log that was removed by the rotation.")
+    }
+    if unchained > 0 {
+        fmt.Printf("%d older event(s) from before the chain aren't covered.\n", unchained)
+    }
+    return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "crypto/sha256"
+    "os"
+    "strings"
+    "testing"
+)
+
+// useLog points baby.log at a new home directory, with the given settings
+// instead of settings.conf.
+func useLog(t *testing.T, values map[string]string) string {
+    t.Setenv("HOME", t.TempDir())
+    settingsOnce.Do(func() {})
+    previous := settings
+    settings = values
+    t.Cleanup(func() { settings = previous })
+    return logPath()
+}
+
+func writeEvents(t *testing.T, events ...string) {
+    for _, event := range events {
+        if err := writeLog(logEntry{Event: event, Details: "Name: " + event}); err != nil {
+            t.Fatalf("writeLog(%s): %v", event, err)
+        }
+    }
+}
+
+func readLog(t *testing.T, path string) []string {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func rewriteLog(t *testing.T, path string, lines []string) {
+    if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestChainLine(t *testing.T) {
+    useLog(t, map[string]string{})
+    line, err := chainLine([]byte(`{"event":"EXECUTE_COMMAND","prev":"abc"}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(string(line), `{"event":"EXECUTE_COMMAND","prev":"abc","hash":"`) {
+        t.Fatalf("chainLine = %s", line)
+    }
+
+    h := sha256.New()
+    sum, ok, valid := lineHash(h, string(line))
+    if !ok || !valid || sum != hashOf(string(line)) {
+        t.Errorf("lineHash(%s) = %s, %v, %v", line, sum, ok, valid)
+    }
+    modified := strings.Replace(string(line), "EXECUTE_COMMAND", "EXECUTE_COMMANDS", 1)
+    if _, ok, valid := lineHash(h, modified); !ok || valid {
+        t.Errorf("lineHash of a modified line = %v, %v, want chained and invalid", ok, valid)
+    }
+    relinked := strings.Replace(string(line), `"prev":"abc"`, `"prev":"abd"`, 1)
+    if _, ok, valid := lineHash(h, relinked); !ok || valid {
+        t.Errorf("lineHash of a line with another prev = %v, %v, want chained and invalid", ok, valid)
+    }
+    if _, ok, _ := lineHash(h, `{"event":"EXECUTE_COMMAND"}`); ok {
+        t.Error("lineHash of an unchained line says it is chained")
+    }
+}
+
+func TestVerifyLog(t *testing.T) {
+    tests := []struct {
+        name   string
+        edit   func([]string) []string
+        broken string
+    }{
+        {"intact", func(lines []string) []string { return lines }, ""},
+        {"removed", func(lines []string) []string {
+            return append(lines[:2:2], lines[3:]...)
+        }, "line 3 of baby.log: the event before it was removed"},
+        {"removed first", func(lines []string) []string {
+            return lines[2:]
+        }, "line 1 of baby.log: the events before it were removed"},
+        {"reordered", func(lines []string) []string {
+            lines[1], lines[2] = lines[2], lines[1]
+            return lines
+        }, "line 2 of baby.log: the event before it was removed or the events were reordered"},
+        {"modified", func(lines []string) []string {
+            lines[3] = strings.Replace(lines[3], "Name: D", "Name: X", 1)
+            return lines
+        }, "line 4 of baby.log: the event was modified"},
+        {"added", func(lines []string) []string {
+            return append(lines, `{"time":"2026-01-01T00:00:00Z","event":"EXECUTE_COMMAND"}`)
+        }, "line 6 of baby.log: the event isn't chained"},
+        {"text", func(lines []string) []string {
+            return append(lines, "[2026-01-01 00:00:00] EXECUTE_COMMAND user at ip | Name: F")
+        }, "written with log.format = text"},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            path := useLog(t, map[string]string{})
+            writeEvents(t, "A", "B", "C", "D", "E")
+            rewriteLog(t, path, test.edit(readLog(t, path)))
+
+            err := verifyLog()
+            switch {
+            case test.broken == "" && err != nil:
+                t.Errorf("verifyLog: %v", err)
+            case test.broken != "" && err == nil:
+                t.Errorf("verifyLog reports an intact chain, want %s", test.broken)
+            case test.broken != "" && !strings.Contains(err.Error(), test.broken):
+                t.Errorf("verifyLog: %v, want %s", err, test.broken)
+            }
+        })
+    }
+}
+
+func TestVerifyLogRotated(t *testing.T) {
+    // Every event goes to a file of its own, only two of them are kept
+    path := useLog(t, map[string]string{"log.max-size": "1", "log.keep": "2", "log.compress": "false"})
+    writeEvents(t, "A", "B", "C", "D", "E")
+    if err := verifyLog(); err != nil {
+        t.Fatalf("verifyLog after pruning: %v", err)
+    }
+    if lines := readLog(t, path); !strings.Contains(lines[0], `"event":"LOG_PRUNED"`) {
+        t.Fatalf("the rotation didn't record the removed file: %s", lines[0])
+    }
+
+    // Without the LOG_PRUNED event nothing tells the cut apart
+    lines := readLog(t, path)
+    rewriteLog(t, path, lines[1:])
+    if err := verifyLog(); err == nil {
+        t.Error("verifyLog reports an intact chain after the anchor was removed")
+    }
+
+    rewriteLog(t, path, lines)
+    if err := os.Remove(path + ".1"); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyLog(); err == nil || !strings.Contains(err.Error(), ".1 is missing") {
+        t.Errorf("verifyLog with a missing rotated file: %v", err)
+    }
+}
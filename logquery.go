@@ -0,0 +1,309 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// logQuery holds the filters of baby log.
+type logQuery struct {
+    types  []string
+    rule   string
+    since  time.Time
+    until  time.Time
+    result string
+    failed bool
+    json   bool
+    last   int
+    follow bool
+}
+
+// parseLogArgs reads the arguments of baby log.
+func parseLogArgs(args []string) (q logQuery, err error) {
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        needsValue := arg == "--type" || arg == "--rule" || arg == "--since" || arg == "--until" || arg == "--result" || arg == "-n"
+        if needsValue && i+1 >= len(args) {
+            return q, fmt.Errorf("%s needs a value", arg)
+        }
+        switch arg {
+        case "--type":
+            for _, t := range splitList(args[i+1]) {
+                q.types = append(q.types, strings.ToUpper(t))
+            }
+            i++
+        case "--rule":
+            q.rule = args[i+1]
+            i++
+        case "--since", "--until":
+            t, err := parseLogTime(args[i+1], arg == "--until")
+            if err != nil {
+                return q, err
+            }
+            if arg == "--since" {
+                q.since = t
+            } else {
+                q.until = t
+            }
+            i++
+        case "--result":
+            q.result = strings.ToLower(args[i+1])
+            i++
+        case "-n":
+            n, err := strconv.Atoi(args[i+1])
+            if err != nil || n <= 0 {
+                return q, fmt.Errorf("'%s' is not a number of events", args[i+1])
+            }
+            q.last = n
+            i++
+        case "--failed":
+            q.failed = true
+        case "--json":
+            q.json = true
+        case "-f":
+            q.follow = true
+        default:
+            return q, fmt.Errorf("unknown argument '%s'", arg)
+        }
+    }
+    return q, nil
+}
+
+// parseLogTime reads the bounds of --since and --until: a date, a date and
+// time, or an age such as 2h or 7d. A date alone is the end of the day for
+// --until, so the day is included.
+func parseLogTime(value string, end bool) (time.Time, error) {
+    if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+        if end {
+            t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+        }
+        return t, nil
+    }
+    for _, layout := range []string{"2006-01-02 15:04", logTimeFormat, time.RFC3339} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    if age, err := parseAge(value); err == nil {
+        return time.Now().Add(-age), nil
+    }
+    return time.Time{}, fmt.Errorf("'%s' is not a date (2006-01-02 [15:04]) or an age (2h, 7d)", value)
+}
+
+// isFailure reports whether an event records something that went wrong.
+func isFailure(e logEntry) bool {
+    switch e.Result {
+    case "failed", "limit exceeded", "not run":
+        return true
+    }
+    if e.ExitCode != nil && *e.ExitCode != 0 {
+        return true
+    }
+    if strings.HasSuffix(e.Event, "_FAILED") {
+        return true
+    }
+    // Text lines only tell it from their details
+    return e.Result == "" && strings.Contains(e.Details, "Result: Error")
+}
+
+func (q logQuery) matches(e logEntry) bool {
+    if len(q.types) > 0 {
+        found := false
+        for _, t := range q.types {
+            found = found || t == e.Event
+        }
+        if !found {
+            return false
+        }
+    }
+    if q.rule != "" && e.Rule != q.rule {
+        return false
+    }
+    if !q.since.IsZero() && e.Time.Before(q.since) {
+        return false
+    }
+    if !q.until.IsZero() && e.Time.After(q.until) {
+        return false
+    }
+    if q.result != "" && e.Result != q.result {
+        return false
+    }
+    if q.failed && !isFailure(e) {
+        return false
+    }
+    return true
+}
+
+// rotatedLogs returns the rotated log files from the oldest to the newest.
+func rotatedLogs(path string) []string {
+    var files []string
+    for n := 1; ; n++ {
+        found := false
+        for _, name := range []string{fmt.Sprintf("%s.%d.gz", path, n), fmt.Sprintf("%s.%d", path, n)} {
+            if _, err := os.Stat(name); err == nil {
+                files = append([]string{name}, files...)
+                found = true
+                break
+            }
+        }
+        if !found {
+            return files
+        }
+    }
+}
+
+// readLogFile sends the events of a log file, compressed or not, to fn.
+func readLogFile(path string, fn func(logEntry)) error {
+    return readLogLines(path, func(line string) bool {
+        if e, ok := parseLogLine(line); ok {
+            fn(e)
+        }
+        return true
+    })
+}
+
+// readLogLines sends the lines of a log file to fn until it returns false.
+func readLogLines(path string, fn func(string) bool) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    var r io.Reader = file
+    if strings.HasSuffix(path, ".gz") {
+        gz, err := gzip.NewReader(file)
+        if err != nil {
+            return fmt.Errorf("failed to read %s: %v", path, err)
+        }
+        defer gz.Close()
+        r = gz
+    }
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+    for scanner.Scan() {
+        if !fn(scanner.Text()) {
+            return nil
+        }
+    }
+    return scanner.Err()
+}
+
+func printLogEntry(e logEntry, asJSON bool) {
+    if asJSON {
+        data, _ := json.Marshal(e)
+        fmt.Println(string(data))
+        return
+    }
+    line := fmt.Sprintf("[%s] %s", e.Time.Local().Format(logTimeFormat), e.Event)
+    if e.Rule != "" {
+        line += " " + e.Rule
+    }
+    if e.Result != "" {
+        line += " " + e.Result
+    }
+    if e.ExitCode != nil && *e.ExitCode != 0 {
+        line += fmt.Sprintf(" (exit code %d)", *e.ExitCode)
+    }
+    if e.Details != "" {
+        line += " | " + e.Details
+    }
+    fmt.Println(line)
+}
+
+// showLog prints the events of baby.log and the rotated logs that match
+// the query. With follow it keeps printing new matching events.
+func showLog(q logQuery) error {
+    path := logPath()
+    var matched []logEntry
+    collect := func(e logEntry) {
+        if q.matches(e) {
+            matched = append(matched, e)
+        }
+    }
+    for _, rotated := range rotatedLogs(path) {
+        if err := readLogFile(rotated, collect); err != nil {
+            fmt.Printf("Warning: %v\n", err)
+        }
+    }
+    if err := readLogFile(path, collect); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to read the log: %v", err)
+    }
+
+    if q.last > 0 && len(matched) > q.last {
+        matched = matched[len(matched)-q.last:]
+    }
+    for _, e := range matched {
+        printLogEntry(e, q.json)
+    }
+    if !q.follow {
+        if len(matched) == 0 && !q.json {
+            fmt.Println("No events found.")
+        }
+        return nil
+    }
+    return followLog(path, q)
+}
+
+// followLog prints the events appended to the log from now on, also
+// after the log is rotated.
+func followLog(path string, q logQuery) error {
+    var file *os.File
+    var reader *bufio.Reader
+    var info os.FileInfo
+    open := func(fromEnd bool) {
+        if file != nil {
+            file.Close()
+            file = nil
+        }
+        f, err := os.Open(path)
+        if err != nil {
+            return
+        }
+        if fromEnd {
+            f.Seek(0, io.SeekEnd)
+        }
+        file, reader = f, bufio.NewReader(f)
+        info, _ = f.Stat()
+    }
+    open(true)
+
+    partial := ""
+    drain := func() {
+        if file == nil {
+            return
+        }
+        for {
+            line, err := reader.ReadString('\n')
+            partial += line
+            if err != nil {
+                return
+            }
+            if e, ok := parseLogLine(partial); ok && q.matches(e) {
+                printLogEntry(e, q.json)
+            }
+            partial = ""
+        }
+    }
+    for {
+        drain()
+        time.Sleep(500 * time.Millisecond)
+        // A rotation replaces the file: the rest of the old one is read
+        // and the new one is read from its start
+        current, err := os.Stat(path)
+        if err != nil {
+            continue
+        }
+        if file == nil || info == nil || !os.SameFile(info, current) {
+            drain()
+            open(false)
+            partial = ""
+        }
+    }
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    journalSocket = "/run/systemd/journal/socket"
+    sinkTimeout   = 2 * time.Second
+    // syslogEnterprise is the private enterprise number of the structured
+    // data, the one RFC 5612 reserves for examples
+    syslogEnterprise = "32473"
+)
+
+var syslogFacilities = map[string]int{
+    "kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+    "local0": 16, "local1": 17, "local2": 18, "local3": 19,
+    "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// logSink forwards the events of baby.log to another logging system. A
+// sink that fails doesn't stop anything: its failure is reported and the
+// sink is left out for the rest of the run, so an unreachable server
+// doesn't hold every event up for the timeout.
+type logSink struct {
+    name    string
+    // network and address are those of net.Dial
+    network string
+    address string
+    format  func(logEntry) []byte
+    conn    net.Conn
+    failed  bool
+}
+
+var (
+    logSinks     []*logSink
+    logSinksOnce sync.Once
+    logSinksMu   sync.Mutex
+)
+
+// loadLogSinks reads the sinks from log.journald and log.syslog.
+func loadLogSinks() []*logSink {
+    logSinksOnce.Do(func() {
+        if getBoolSetting("log.journald", false) {
+            logSinks = append(logSinks, &logSink{name: "journald", network: "unixgram", address: journalSocket, format: journalMessage})
+        }
+        if value := getSetting("log.syslog", ""); value != "" {
+            sink, err := newSyslogSink(value)
+            if err != nil {
+                fmt.Printf("Warning: Invalid log.syslog: %v\n", err)
+                return
+            }
+            logSinks = append(logSinks, sink)
+        }
+    })
+    return logSinks
+}
+
+// newSyslogSink reads a syslog address: udp://host:port, tcp://host:port
+// or unix:///dev/log.
+func newSyslogSink(value string) (*logSink, error) {
+    u, err := url.Parse(value)
+    if err != nil {
+        return nil, err
+    }
+    facility := getSetting("log.syslog-facility", "user")
+    code, ok := syslogFacilities[facility]
+    if !ok {
+        return nil, fmt.Errorf("unknown log.syslog-facility '%s'", facility)
+    }
+    sink := &logSink{name: "syslog", format: func(e logEntry) []byte { return syslogMessage(e, code) }}
+    switch u.Scheme {
+    case "udp", "tcp":
+        if u.Port() == "" {
+            port := "514"
+            if u.Scheme == "tcp" {
+                port = "601"
+            }
+            u.Host = net.JoinHostPort(u.Hostname(), port)
+        }
+        sink.network, sink.address = u.Scheme, u.Host
+    case "unix":
+        sink.network, sink.address = "unixgram", u.Path
+    default:
+        return nil, fmt.Errorf("'%s' should start with udp://, tcp:// or unix://", value)
+    }
+    return sink, nil
+}
+
+// forwardLog sends an entry to the configured sinks.
+func forwardLog(e logEntry) {
+    sinks := loadLogSinks()
+    if len(sinks) == 0 {
+        return
+    }
+    logSinksMu.Lock()
+    defer logSinksMu.Unlock()
+    for _, sink := range sinks {
+        if sink.failed {
+            continue
+        }
+        if err := sink.send(e); err != nil {
+            sink.failed = true
+            fmt.Printf("Warning: Failed to send events to %s, they are only in baby.log: %v\n", sink.name, err)
+        }
+    }
+}
+
+// send writes an entry, connecting again once if the connection broke.
+func (s *logSink) send(e logEntry) error {
+    var err error
+    for attempt := 0; attempt < 2; attempt++ {
+        if s.conn == nil {
+            if s.conn, err = s.dial(); err != nil {
+                return err
+            }
+        }
+        message := s.format(e)
+        switch s.network {
+        case "tcp":
+            // Syslog servers read the octet counting framing of RFC 6587
+            message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+        case "unix":
+            // The local daemons behind a stream /dev/log split messages on
+            // NUL and line feeds, a count would end up in the message
+            message = append(message, '\n')
+        }
+        s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+        if _, err = s.conn.Write(message); err == nil {
+            return nil
+        }
+        s.conn.Close()
+        s.conn = nil
+    }
+    return err
+}
+
+func (s *logSink) dial() (net.Conn, error) {
+    conn, err := net.DialTimeout(s.network, s.address, sinkTimeout)
+    // /dev/log is a stream socket on some systems
+    if err != nil && s.network == "unixgram" && s.name == "syslog" {
+        if conn, err = net.DialTimeout("unix", s.address, sinkTimeout); err == nil {
+            s.network = "unix"
+        }
+    }
+    return conn, err
+}
+
+// journalMessage encodes an entry in the native protocol of the systemd
+// journal, one FIELD=value per line. Values with a line feed are written
+// as the name, a line feed, their little endian 64 bit length and the
+// value.
+func journalMessage(e logEntry) []byte {
+    var buf bytes.Buffer
+    field := func(name, value string) {
+        if value == "" {
+            return
+        }
+        if !strings.Contains(value, "\n") {
+            fmt.Fprintf(&buf, "%s=%s\n", name, value)
+            return
+        }
+        buf.WriteString(name + "\n")
+        binary.Write(&buf, binary.LittleEndian, uint64(len(value)))
+        buf.WriteString(value + "\n")
+    }
+    priority := "6"
+    if isFailure(e) {
+        priority = "3"
+    }
+    message := e.Event
+    if e.Details != "" {
+        message += " | " + e.Details
+    }
+    field("MESSAGE", message)
+    field("PRIORITY", priority)
+    field("SYSLOG_IDENTIFIER", "baby")
+    field("EVENT", e.Event)
+    field("BABY_USER", e.User)
+    field("BABY_IP", e.IP)
+    field("RULE", e.Rule)
+    field("COMMAND", e.Command)
+    if e.ExitCode != nil {
+        field("EXIT_CODE", strconv.Itoa(*e.ExitCode))
+    }
+    if e.Duration != nil {
+        field("DURATION", strconv.FormatFloat(*e.Duration, 'f', -1, 64))
+    }
+    field("RUN_ID", e.RunID)
+    field("RESULT", e.Result)
+    return buf.Bytes()
+}
+
+// syslogMessage encodes an entry as an RFC 5424 message, with the fields
+// of the entry as structured data.
+func syslogMessage(e logEntry, facility int) []byte {
+    severity := 6
+    if isFailure(e) {
+        severity = 3
+    }
+    hostname, err := os.Hostname()
+    if err != nil || hostname == "" {
+        hostname = "-"
+    }
+
+    var params []string
+    param := func(name, value string) {
+        if value == "" {
+            return
+        }
+        value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+        params = append(params, fmt.Sprintf(`%s="%s"`, name, value))
+    }
+    param("user", e.User)
+    param("ip", e.IP)
+    param("rule", e.Rule)
+    param("command", e.Command)
+    if e.ExitCode != nil {
+        param("exit_code", strconv.Itoa(*e.ExitCode))
+    }
+    if e.Duration != nil {
+        param("duration", strconv.FormatFloat(*e.Duration, 'f', -1, 64))
+    }
+    param("run_id", e.RunID)
+    param("result", e.Result)
+    data := "-"
+    if len(params) > 0 {
+        data = "[baby@" + syslogEnterprise + " " + strings.Join(params, " ") + "]"
+    }
+
+    message := fmt.Sprintf("<%d>1 %s %s baby %d %s %s", facility*8+severity,
+        e.Time.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, os.Getpid(), e.Event, data)
+    if e.Details != "" {
+        message += " " + e.Details
+    }
+    return []byte(message)
+}
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"os"
 	"html"
-	"net"
+	"io"
 	"path/filepath"
 	"os/exec"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 	"log"
 
@@ -23,7 +27,13 @@ const (
     configFileName = "baby.conf"
     logDir = "/.local/share/baby/"
     logFileName = "baby.log"
+    stateDir = "/.local/state/baby/"
     VERSION = "1.0.58"
+
+    // Time a command gets to exit after SIGTERM before it is killed
+    killGracePeriod = 5 * time.Second
+    // First delay between retries, doubled after every failed attempt
+    defaultBackoff = time.Second
 )
 
 var configFile = filepath.Join(os.Getenv("HOME"), configDir, configFileName)
@@ -31,7 +41,11 @@ var configFile = filepath.Join(os.Getenv("HOME"), configDir, configFileName)
 var reservedNames = []string{
     "-h", "-l", "-n", "-r", "-c", "-ln", "-v", "-i", "-e", "-b",
     "-H", "-L", "-N", "-R", "-C", "-LN", "-V", "-I", "-E", "-B",
-    "-lN", "-Ln",
+    "-lN", "-Ln", "-s", "-S",
+
+    // Built-in commands
+    "jobs", "logs", "kill", "scheduler", "output", "history", "rerun", "!!",
+    "build", "graph", "resume", "watch", "replay", "log", "stats",
 
     // Reserved for future implementations
     "-g", "-G", "-w", "-W", "-t", "-T", "-x", "-X", "-y", "-Y",
@@ -40,6 +54,19 @@ var reservedNames = []string{
 
 func main() {
 
+    // Internal wrappers of the command of a rule. They run before the
+    // config file is opened so nothing in a sandbox sees it change.
+    if len(os.Args) == 5 && os.Args[1] == "__exec" {
+        // Applies the limits of a rule and becomes its command
+        execLimited(os.Args[2], os.Args[3], os.Args[4])
+        return
+    }
+    if len(os.Args) >= 5 && os.Args[1] == "__sandbox" {
+        // Sets up the sandbox of a rule and runs its command
+        runSandbox(os.Args[2], os.Args[3], os.Args[4:])
+        return
+    }
+
     // Initialize the config file
     homeDir, err := os.UserHomeDir()
     if err != nil {
@@ -55,10 +82,51 @@ func main() {
     args := os.Args[1:]
 
     bottleValues := make(map[string]string)
+    var opts runOptions
     var commands []string
 
     for i := 0; i < len(args); i++ {
-        if strings.HasPrefix(args[i], "-b=") {
+        if args[i] == "--bg" {
+            opts.background = true
+        } else if args[i] == "--no-prompt" {
+            opts.noPrompt = true
+        } else if args[i] == "--yes" {
+            opts.yes = true
+        } else if args[i] == "--usage" {
+            opts.usage = true
+        } else if args[i] == "--sandbox" {
+            opts.sandbox = true
+        } else if args[i] == "--record" {
+            opts.record = true
+        } else if strings.HasPrefix(args[i], "--record=") {
+            opts.record = true
+            opts.recordPath = strings.TrimPrefix(args[i], "--record=")
+        } else if args[i] == "--report" || strings.HasPrefix(args[i], "--report=") {
+            value := strings.TrimPrefix(args[i], "--report=")
+            if args[i] == "--report" && i+1 < len(args) {
+                i++
+                value = args[i]
+            }
+            report, err := parseReport(value)
+            if err != nil {
+                fmt.Printf("Error: Incorrect usage of --report: %v, e.g. --report junit=report.xml\n", err)
+                return
+            }
+            opts.reports = append(opts.reports, report)
+        } else if strings.HasPrefix(args[i], "--timeout=") {
+            timeout, err := time.ParseDuration(strings.TrimPrefix(args[i], "--timeout="))
+            if err != nil || timeout <= 0 {
+                fmt.Println("Error: Incorrect usage of --timeout. It should be a duration, e.g. --timeout=30s")
+                return
+            }
+            opts.timeout = timeout
+        } else if strings.HasPrefix(args[i], "--bottles-fd=") {
+            // Internal, the scheduler and watch start their rules with it
+            if err := readBottles(strings.TrimPrefix(args[i], "--bottles-fd="), bottleValues); err != nil {
+                fmt.Println("Error: Failed to read the bottles:", err)
+                return
+            }
+        } else if strings.HasPrefix(args[i], "-b=") {
             parts := strings.SplitN(args[i], "=", 2)
             if len(parts) == 2 {
                 bottleParts := strings.SplitN(parts[1], ":", 2)
@@ -117,6 +185,14 @@ func main() {
         }
         name := commands[1]
         showRule(name)
+    case "-s":
+        if len(commands) < 3 {
+            fmt.Println("Error: Incorrect usage of -s. It should be: baby -s <name> <option> ['<value>']")
+            return
+        }
+        name := commands[1]
+        value := strings.Join(commands[3:], " ")
+        setRuleOption(name, commands[2], value)
     case "-v":
         fmt.Println("Baby version", VERSION)
     case "-i":
@@ -128,13 +204,231 @@ func main() {
         importRulesFromFile(importSource)
     case "-e":
         exportRules()
+    case "jobs":
+        if len(commands) == 2 && commands[1] == "clear" {
+            clearJobs()
+            return
+        }
+        listJobs()
+    case "logs":
+        id, lines, follow, ok := parseLogsArgs(commands[1:])
+        if !ok {
+            fmt.Println("Error: Incorrect usage of logs. It should be: baby logs <job> [-n <lines>] [-f]")
+            return
+        }
+        showJobLogs(id, lines, follow)
+    case "log":
+        if len(commands) == 2 && commands[1] == "verify" {
+            if err := verifyLog(); err != nil {
+                fmt.Println("Error:", err)
+                os.Exit(1)
+            }
+            return
+        }
+        q, err := parseLogArgs(commands[1:])
+        if err != nil {
+            fmt.Printf("Error: %v. It should be: baby log [--type <event>] [--rule <name>] [--since <date>] [--until <date>] [--result <result>] [--failed] [--json] [-n <events>] [-f]\n", err)
+            return
+        }
+        if err := showLog(q); err != nil {
+            fmt.Println("Error:", err)
+            os.Exit(1)
+        }
+    case "stats":
+        so, err := parseStatsArgs(commands[1:])
+        if err != nil {
+            fmt.Printf("Error: %v. It should be: baby stats [--since <date>] [--unused <days>] [--top <N>] [--slower <factor>] [--json]\n", err)
+            return
+        }
+        if err := showStats(so); err != nil {
+            fmt.Println("Error:", err)
+            os.Exit(1)
+        }
+    case "kill":
+        if len(commands) != 2 {
+            fmt.Println("Error: Incorrect usage of kill. It should be: baby kill <job>")
+            return
+        }
+        id, err := strconv.Atoi(commands[1])
+        if err != nil {
+            fmt.Printf("Error: '%s' is not a job number.\n", commands[1])
+            return
+        }
+        killJob(id)
+    case "scheduler":
+        if len(commands) == 2 && commands[1] == "status" {
+            showSchedule()
+            return
+        }
+        if len(commands) != 1 {
+            fmt.Println("Error: Incorrect usage of scheduler. It should be: baby scheduler [status]")
+            return
+        }
+        runScheduler(bottleValues, opts)
+    case "output":
+        rule, last, ok := parseOutputArgs(commands[1:])
+        if !ok {
+            fmt.Println("Error: Incorrect usage of output. It should be: baby output <name> [--last <N>]")
+            return
+        }
+        showRunOutputs(rule, last)
+    case "history":
+        last := 20
+        if len(commands) == 2 {
+            n, err := strconv.Atoi(commands[1])
+            if err != nil || n < 1 {
+                fmt.Println("Error: Incorrect usage of history. It should be: baby history [<N>]")
+                return
+            }
+            last = n
+        } else if len(commands) > 2 {
+            fmt.Println("Error: Incorrect usage of history. It should be: baby history [<N>]")
+            return
+        }
+        showHistory(last)
+    case "rerun", "!!":
+        id := ""
+        if commands[0] == "rerun" {
+            if len(commands) != 2 {
+                fmt.Println("Error: Incorrect usage of rerun. It should be: baby rerun <id>")
+                return
+            }
+            id = commands[1]
+        } else if len(commands) != 1 {
+            fmt.Println("Error: Incorrect usage of !!. It should be: baby '!!'")
+            return
+        }
+        if err := rerun(id, bottleValues, opts); err != nil {
+            os.Exit(exitCodeOf(err))
+        }
+    case "build":
+        targets, jobs, ok := parseBuildArgs(commands[1:])
+        if !ok {
+            fmt.Println("Error: Incorrect usage of build. It should be: baby build [-j <N>] [<name>...]")
+            return
+        }
+        if err := buildRules(targets, bottleValues, opts, jobs); err != nil {
+            os.Exit(exitCodeOf(err))
+        }
+    case "graph":
+        showGraph(commands[1:])
+    case "watch":
+        rule, wo, ok := parseWatchArgs(commands[1:])
+        if !ok {
+            fmt.Println("Error: Incorrect usage of watch. It should be: baby watch <name> [--path <dir>] [--glob '<pattern>'] [--debounce <duration>] [--restart]")
+            return
+        }
+        if opts.background {
+            fmt.Println("Error: --bg can't be used with watch, the watch itself runs in the foreground")
+            return
+        }
+        watchRule(rule, wo, bottleValues, opts)
+    case "replay":
+        path, speed, idle, ok := parseReplayArgs(commands[1:])
+        if !ok {
+            fmt.Println("Error: Incorrect usage of replay. It should be: baby replay <file> [--speed <factor>] [--idle <duration>]")
+            return
+        }
+        if err := replayRecording(path, speed, idle); err != nil {
+            fmt.Println("Error:", err)
+            os.Exit(1)
+        }
+    case "resume":
+        if len(commands) == 1 {
+            listCheckpoints()
+            return
+        }
+        if len(commands) != 2 {
+            fmt.Println("Error: Incorrect usage of resume. It should be: baby resume [<name>]")
+            return
+        }
+        if err := resumeRule(commands[1], bottleValues, opts); err != nil {
+            os.Exit(exitCodeOf(err))
+        }
+    case "__job":
+        // Internal: the detached process of a background job
+        if id, err := strconv.Atoi(commands[len(commands)-1]); err == nil {
+            runJob(id)
+        }
     default:
         if strings.HasPrefix(commands[0], "-") {
             fmt.Println("Unrecognized option. Use baby -h to see the available options.")
-        } else {
-            runCommands(commands, bottleValues)
+        } else if opts.background && len(opts.reports) > 0 {
+            fmt.Println("Error: --report can't be used with --bg, the job's output is in 'baby logs'")
+        } else if opts.background {
+            startBackgroundJob(commands, bottleValues, opts)
+        } else if err := runCommands(commands, bottleValues, opts); err != nil {
+            os.Exit(exitCodeOf(err))
+        }
+    }
+}
+
+// parseLogsArgs reads the arguments of baby logs.
+func parseLogsArgs(args []string) (id, lines int, follow, ok bool) {
+    lines = 20
+    id = -1
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "-f":
+            follow = true
+        case args[i] == "-n" && i+1 < len(args):
+            n, err := strconv.Atoi(args[i+1])
+            if err != nil {
+                return 0, 0, false, false
+            }
+            lines = n
+            i++
+        default:
+            n, err := strconv.Atoi(args[i])
+            if err != nil || id != -1 {
+                return 0, 0, false, false
+            }
+            id = n
         }
     }
+    return id, lines, follow, id != -1
+}
+
+// parseBuildArgs reads the arguments of baby build.
+func parseBuildArgs(args []string) (targets []string, jobs int, ok bool) {
+    jobs = buildJobs()
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "-j" && i+1 < len(args):
+            n, err := strconv.Atoi(args[i+1])
+            if err != nil || n < 1 {
+                return nil, 0, false
+            }
+            jobs = n
+            i++
+        case strings.HasPrefix(args[i], "-"):
+            return nil, 0, false
+        default:
+            targets = append(targets, args[i])
+        }
+    }
+    return targets, jobs, true
+}
+
+// parseOutputArgs reads the arguments of baby output.
+func parseOutputArgs(args []string) (rule string, last int, ok bool) {
+    last = 1
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--last" && i+1 < len(args):
+            n, err := strconv.Atoi(args[i+1])
+            if err != nil || n < 1 {
+                return "", 0, false
+            }
+            last = n
+            i++
+        case rule == "" && !strings.HasPrefix(args[i], "-"):
+            rule = args[i]
+        default:
+            return "", 0, false
+        }
+    }
+    return rule, last, rule != ""
 }
 
 func showHelp() {
@@ -147,18 +441,62 @@ func showHelp() {
     fmt.Println(" -r a \t\t\tDelete all rules")
     fmt.Println(" -c <name> '<command>'\tUpdate the command of a rule")
     fmt.Println(" -ln <name>\t\tShow the contents of a specific rule")
+    fmt.Println(" -s <name> <option> '<value>'")
+    fmt.Println("\t\t\tSet an option of a rule, leave the value empty to remove it")
+    fmt.Println("\t\t\tOptions: cwd <dir>, env NAME=value, envfile <file>,")
+    fmt.Println("\t\t\ttimeout <duration>, retries <count>, backoff <duration>,")
+    fmt.Println("\t\t\tschedule 'every 15m'|'<cron>', catchup true|false,")
+    fmt.Println("\t\t\tconfirm true|false, before '<command>', after '<command>',")
+    fmt.Println("\t\t\tif-file <path>, if-bin <name>[>=version], if-host <name>,")
+    fmt.Println("\t\t\tif-user <name>, if-check '<command>', on-unmet skip|fail,")
+    fmt.Println("\t\t\tvariant.<distribution id> '<command>', capture true|false,")
+    fmt.Println("\t\t\tneeds <name>, inputs <pattern>, outputs <pattern>,")
+    fmt.Println("\t\t\tstep '<step name>: <command>', limit-cpu <duration>,")
+    fmt.Println("\t\t\tlimit-as <size>, limit-files <count>,")
+    fmt.Println("\t\t\tlimit-procs <count> (counts every process of the user),")
+    fmt.Println("\t\t\tcgroup-memory <size>, cgroup-cpu <percent>%, pty auto|true|false")
     fmt.Println(" -h\t\t\tShow this help")
     fmt.Println(" -v\t\t\tShow the program version")
     fmt.Println(" -i <file path>\t\tImport rules from a local file")
     fmt.Println(" -e\t\t\tExport rules to a text file (backup)")
     fmt.Println(" -b=<variable:value>\tPre-define the content of a bottle")
-    fmt.Println("\t\t\tSyntax for create bottles: b%('variable')%b")
+    fmt.Printf("\t\t\tSyntax for create bottles: b%%('variable')%%b\n")
+    fmt.Println(" --timeout=<duration>\tStop the rules if they run longer than this, e.g. 10m")
+    fmt.Println(" --no-prompt\t\tFail instead of asking for bottles without a value")
+    fmt.Println(" --yes\t\t\tRun rules that need confirmation without asking")
+    fmt.Println(" --usage\t\tShow the CPU time, memory and disk I/O of the rules at the end")
+    fmt.Println(" --sandbox\t\tRun the rules without network on a read-only file system,\n\t\t\twrites to $HOME and the temporary directories are thrown away")
+    fmt.Println(" --record[=<file>]\tRecord the terminal output of the run as an asciicast file")
+    fmt.Println(" --report junit=<file>\tWrite a JUnit XML report of the rules, json=<file> for JSON")
+    fmt.Println(" --bg <name> [<name>...]\tRun rules in the background as a job")
+    fmt.Println(" jobs\t\t\tList background jobs, 'jobs clear' removes finished ones")
+    fmt.Println(" logs <job> [-n N] [-f]\tShow the output of a job, -f follows it")
+    fmt.Println(" log [--type <event>] [--rule <name>] [--since <date>] [--until <date>]")
+    fmt.Println("     [--result <result>] [--failed] [--json] [-n N] [-f]")
+    fmt.Println("\t\t\tShow the events of baby.log that match, -f follows new ones")
+    fmt.Println(" log verify\t\tCheck that no event of baby.log was removed, reordered or modified")
+    fmt.Println(" stats [--since <date>] [--unused <days>] [--top N] [--slower <factor>] [--json]")
+    fmt.Println("\t\t\tShow the most used, failing, unused and slower rules")
+    fmt.Println(" kill <job>\t\tStop a background job")
+    fmt.Println(" scheduler\t\tRun the rules that have a schedule when they are due")
+    fmt.Println(" scheduler status\tShow the last and next run of the scheduled rules")
+    fmt.Println(" output <name> [--last N]\tShow the captured output of the last runs of a rule")
+    fmt.Println(" history [N]\t\tShow the last runs, 20 by default")
+    fmt.Println(" rerun <id>\t\tRun a past run again with the same bottle values")
+    fmt.Println(" !!\t\t\tRun the last run again")
+    fmt.Println(" build [-j N] [<name>...]\tRun rules and the rules they need, skipping up to date ones")
+    fmt.Println(" graph [<name>...]\tPrint the dependency graph of the rules in DOT format")
+    fmt.Println(" resume [<name>]\tContinue a rule made of steps from the step that failed")
+    fmt.Println(" replay <file> [--speed <factor>] [--idle <duration>]")
+    fmt.Println("\t\t\tPlay a recording made with --record")
+    fmt.Println(" watch <name> [--path <dir>] [--glob '<pattern>'] [--debounce <duration>] [--restart]")
+    fmt.Println("\t\t\tRun a rule again every time the watched files change")
     fmt.Println(" ")
     fmt.Println("Usage examples:")
     fmt.Println(" Create a new rule: baby -n update 'sudo apt update -y'")
     fmt.Println(" The next time just run: baby update")
     fmt.Println(" ")
-    fmt.Println(" Create a new rule with bottle: baby -n ssh 'ssh -p 2222 b%('username')%b@example.com'")
+    fmt.Printf(" Create a new rule with bottle: baby -n ssh 'ssh -p 2222 b%%('username')%%b@example.com'\n")
     fmt.Println(" The next time you run 'baby ssh' the system will ask you for the username value")
     fmt.Println(" ")
     fmt.Println("For further help go to https://github.com/manuwarfare/baby")
@@ -167,35 +505,30 @@ func showHelp() {
 }
 
 func listRules() {
-    file, err := os.Open(configFile)
+    rules, err := loadRules()
     if err != nil {
         fmt.Println("Failed to open the configuration file:", err)
         fmt.Println("No rules have been created in Baby yet.")
         return
     }
-    defer file.Close()
 
-    scanner := bufio.NewScanner(file)
-    var found bool
-    for scanner.Scan() {
-        line := scanner.Text()
-        parts := strings.SplitN(line, "=", 2)
-        if len(parts) != 2 {
-            continue
+    for _, rule := range rules {
+        command, variant := selectVariant(rule)
+        switch {
+        case len(rule.Options["step"]) > 0:
+            fmt.Printf("%s = %s (%d steps)\n", rule.Name, rule.Command, len(rule.Options["step"]))
+        case variant != "":
+            fmt.Printf("%s = %s (%s variant)\n", rule.Name, command, variant)
+        case hasVariants(rule):
+            fmt.Printf("%s = %s (no variant for this distribution)\n", rule.Name, command)
+        default:
+            fmt.Printf("%s = %s\n", rule.Name, command)
         }
-        name := strings.TrimSpace(parts[0])
-        command := strings.TrimSpace(parts[1])
-        fmt.Printf("%s = %s\n", name, command)
-        found = true
     }
 
-    if !found {
+    if len(rules) == 0 {
         fmt.Println("No rules have been created in Baby yet.")
     }
-
-    if err := scanner.Err(); err != nil {
-        fmt.Println("Error reading the configuration file:", err)
-    }
 }
 
 func createRule(name, command string) {
@@ -210,6 +543,11 @@ func createRule(name, command string) {
         return
     }
 
+    if _, key := splitOptionName(name); key != "" {
+        fmt.Printf("Unable to create a rule with this name. '%s' ends with the rule option '.%s'.\n", name, key)
+        return
+    }
+
     found := false
     for i, line := range lines {
         if strings.HasPrefix(line, name+" = ") {
@@ -237,7 +575,8 @@ func createRule(name, command string) {
     }
 
     // write the events in baby.log
-    err = logEvent("CREATE_RULE", fmt.Sprintf("Name: %s, Command: %s", name, command))
+    err = writeLog(logEntry{Event: "CREATE_RULE", Rule: name, Command: command,
+        Details: fmt.Sprintf("Name: %s, Command: %s", name, command)})
     if err != nil {
         fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
@@ -253,13 +592,19 @@ func deleteRule(name string) {
     }
 
     found := false
-    for i, line := range lines {
+    var remaining []string
+    for _, line := range lines {
         if strings.HasPrefix(line, name+" = ") {
-            lines = append(lines[:i], lines[i+1:]...)
             found = true
-            break
+            continue
         }
+        // Drop the options stored for the rule as well
+        if lineName, key, _, ok := parseConfigLine(line); ok && key != "" && lineName == name {
+            continue
+        }
+        remaining = append(remaining, line)
     }
+    lines = remaining
 
     if !found {
         fmt.Printf("Rule '%s' not found.\n", name)
@@ -273,7 +618,7 @@ func deleteRule(name string) {
     }
 
     // write events in baby.log
-    err = logEvent("DELETE_RULE", fmt.Sprintf("Name: %s", name))
+    err = writeLog(logEntry{Event: "DELETE_RULE", Rule: name, Details: fmt.Sprintf("Name: %s", name)})
     if err != nil {
         fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
@@ -336,7 +681,8 @@ func updateRule(name, command string) {
     }
 
     // write events in baby.log
-    err = logEvent("UPDATE_RULE", fmt.Sprintf("Name: %s, New Command: %s", name, command))
+    err = writeLog(logEntry{Event: "UPDATE_RULE", Rule: name, Command: command,
+        Details: fmt.Sprintf("Name: %s, New Command: %s", name, command)})
     if err != nil {
         fmt.Printf("Warning: Failed to log event: %v\n", err)
     }
@@ -365,64 +711,846 @@ func showRule(name string) {
 
     if !found {
         fmt.Printf("Rule '%s' does not exist.\n", name)
+        return
     }
+
+    rule, err := loadRule(name)
+    if err != nil {
+        return
+    }
+    for _, key := range sortedOptionKeys(rule) {
+        // Conditions are listed below together with their status
+        if strings.HasPrefix(key, "if-") {
+            continue
+        }
+        for _, value := range rule.Options[key] {
+            fmt.Printf("  %s: %s\n", key, value)
+        }
+    }
+    if hasVariants(rule) {
+        if _, variant := selectVariant(rule); variant != "" {
+            fmt.Printf("The %s variant applies on this machine.\n", variant)
+        } else {
+            fmt.Println("No variant applies on this machine, the rule's own command is used.")
+        }
+    }
+    showConditions(rule)
 }
 
-func runCommands(commands []string, bottleValues map[string]string) {
-    var processedCommands []string
+// runOptions holds the settings given on the command line for a single
+// invocation of baby.
+type runOptions struct {
+    timeout    time.Duration
+    background bool
+    // noPrompt makes rules with unfilled bottles fail instead of asking
+    noPrompt bool
+    // yes runs rules that need confirmation without asking
+    yes bool
+    // resume skips the steps that succeeded in the last run of a rule
+    resume bool
+    // usage shows the resource usage of the rules at the end of the run
+    usage bool
+    // sandbox runs the rules without network and without changing files
+    sandbox bool
+    // record saves the terminal output of the run as an asciicast file,
+    // to recordPath or to the recordings directory
+    record     bool
+    recordPath string
+    recorder   *castRecorder
+    // reports are written at the end of the run, for CI
+    reports []runReport
+    // ruleBottles are bottle values answered earlier for single rules, by
+    // a background job or a rerun. Values given with -b win over them.
+    ruleBottles map[string]map[string]string
+    // stop ends the run before its next rule once it receives a signal
+    stop <-chan os.Signal
+}
+
+// runCommands runs the rules in order and returns the first error, if
+// any of them failed.
+func runCommands(commands []string, bottleValues map[string]string, opts runOptions) error {
+    runID := newRunID()
+    history := newHistoryEntry(runID, commands)
+
+    var prepared []*preparedRule
+    var firstErr error
     for _, cmd := range commands {
-        rule, err := getCommand(cmd)
-        if err != nil {
-            fmt.Printf("Error: %s\n", err)
-            continue
+        rule, err := loadRule(cmd)
+        if err == nil {
+            var p *preparedRule
+            if p, err = prepareRule(rule, bottleValues, opts); err == nil {
+                prepared = append(prepared, p)
+                continue
+            }
+        }
+        fmt.Printf("Error: %s\n", err)
+        history.addResult(cmd, "", "", "not run", err, 0, nil)
+        if firstErr == nil {
+            firstErr = err
         }
-        processedRule := processBottles(rule, bottleValues)
-        processedCommands = append(processedCommands, processedRule)
     }
-    if len(processedCommands) == 0 {
+    history.setBottles(bottleValues)
+    history.setRuleBottles(prepared)
+    if len(prepared) == 0 {
         fmt.Println("No rules found to execute.")
-        return
+        // The history, the metrics and CI still get the rules that couldn't run
+        saveRun(history, firstErr, opts.reports)
+        return fmt.Errorf("no rules found to execute")
+    }
+
+    defer func() {
+        saveRun(history, firstErr, opts.reports)
+    }()
+    defer pruneRunOutputs()
+    opts.recorder = startRecording(opts, runID, commands)
+    defer finishRecording(opts.recorder, runID)
+
+    for i, p := range prepared {
+        // A signal that came between two rules stops the batch as well
+        var stopped os.Signal
+        select {
+        case stopped = <-opts.stop:
+        default:
+        }
+        if stopped != nil {
+            fmt.Printf("Stopping before command %d: %v\n", i+1, stopped)
+            if firstErr == nil {
+                firstErr = &signalError{signal: stopped}
+            }
+            break
+        }
+        err := runPreparedRule(i, p, runID, history, opts)
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+        // An interrupted rule stops the whole batch, like it would in a shell
+        if _, ok := err.(*signalError); ok {
+            break
+        }
+    }
+    if usageSummaryEnabled(opts) {
+        showUsageSummary(history.Results)
     }
-    for i, command := range processedCommands {
-        start := time.Now()
-        fmt.Printf("Executing command %d: %s\n", i+1, command)
-        err := executeCommand(command)
-        duration := time.Since(start)
+    return firstErr
+}
 
-        result := "Success"
+// runPreparedRule checks the conditions of the i-th rule of a run, asks
+// for confirmation if needed and executes it with its hooks. The result is
+// logged and added to the history of the run.
+func runPreparedRule(i int, p *preparedRule, runID string, history *HistoryEntry, opts runOptions) error {
+    if unmet := unmetConditions(p); len(unmet) > 0 {
+        reason := strings.Join(unmet, ", ")
+        if p.rule.option("on-unmet") == "skip" {
+            fmt.Printf("Skipping command %d, rule '%s' conditions not met: %s\n", i+1, p.rule.Name, reason)
+            logWarning(writeLog(logEntry{Event: "EXECUTE_SKIPPED", Rule: p.rule.Name, RunID: runID, Result: "skipped",
+                Details: fmt.Sprintf("Name: %s, Unmet: %s", p.rule.Name, reason)}))
+            history.addResult(p.rule.Name, p.command, p.dir, "skipped", nil, 0, nil)
+            return nil
+        }
+        err := fmt.Errorf("conditions of rule '%s' not met: %s", p.rule.Name, reason)
+        fmt.Printf("Error executing command %d: %s\n", i+1, err)
+        logWarning(writeLog(logEntry{Event: "CONDITION_FAILED", Rule: p.rule.Name, RunID: runID, Result: "not run",
+            Details: fmt.Sprintf("Name: %s, Unmet: %s", p.rule.Name, reason)}))
+        history.addResult(p.rule.Name, p.command, p.dir, "not run", err, 0, nil)
+        return err
+    }
+
+    if !confirmRule(p, opts) {
+        err := fmt.Errorf("rule '%s' was not confirmed", p.rule.Name)
+        fmt.Printf("Skipping command %d: %s\n", i+1, err)
+        logWarning(writeLog(logEntry{Event: "EXECUTE_DECLINED", Rule: p.rule.Name, Command: p.command, RunID: runID, Result: "declined",
+            Details: fmt.Sprintf("Name: %s, Command: \"%s\"", p.rule.Name, p.command)}))
+        history.addResult(p.rule.Name, p.command, p.dir, "declined", err, 0, nil)
+        return err
+    }
+
+    fmt.Printf("Executing command %d: %s\n", i+1, p.command)
+    if opts.recorder != nil {
+        p.record = opts.recorder
+        p.record.marker(p.rule.Name)
+        fmt.Fprintf(p.record, "Executing command %d: %s\n", i+1, p.command)
+    }
+
+    if captureEnabled(p.rule) {
+        output, err := createRunOutput(runID, i+1, p.rule.Name)
         if err != nil {
-            result = fmt.Sprintf("Error: %v", err)
-            fmt.Printf("Error executing command %d: %s\n", i+1, err)
+            fmt.Printf("Warning: The output won't be captured: %v\n", err)
+        } else {
+            p.output = output
+        }
+    }
+
+    if len(opts.reports) > 0 {
+        p.stderr = &tailBuffer{max: maxReportStderr}
+    }
+
+    // A failing before hook aborts the rule, after hooks only run when
+    // the command did
+    p.usage = &resourceUsage{}
+    err := runHooks(hookBefore, p, nil, 0)
+    attempts := 0
+    start := time.Now()
+    if err == nil && len(p.steps) > 0 {
+        attempts, err = executeSteps(i, p, runID, opts.resume)
+    } else if err == nil {
+        attempts, err = executeWithRetries(i, p)
+    }
+    if p.output != nil {
+        p.output.Close()
+    }
+    duration := time.Since(start)
+
+    result := "Success"
+    status := "success"
+    if limitErr, ok := err.(*limitError); ok {
+        result = fmt.Sprintf("Limit exceeded: %s", limitErr.limit)
+        status = "limit exceeded"
+        fmt.Printf("Error executing command %d: %s\n", i+1, err)
+    } else if err != nil {
+        result = fmt.Sprintf("Error: %v", err)
+        status = "failed"
+        fmt.Printf("Error executing command %d: %s\n", i+1, err)
+    }
+
+    logDetails := fmt.Sprintf("Command: \"%s\", Result: %s in %v", p.command, result, duration)
+    if attempts > 1 {
+        logDetails += fmt.Sprintf(", Attempts: %d", attempts)
+    }
+    if attempts > 0 {
+        logDetails += ", " + p.usage.String()
+    }
+    logDetails += fmt.Sprintf(", Run: %s", runID)
+    entry := logEntry{Event: "EXECUTE_COMMAND", Rule: p.rule.Name, Command: p.command, RunID: runID,
+        Result: status, Details: logDetails}.withExit(err, duration)
+    if attempts > 0 {
+        entry.Usage = p.usage
+    }
+    logWarning(writeLog(entry))
+    history.addResult(p.rule.Name, p.command, p.dir, status, err, duration, p.usage)
+    if p.stderr != nil {
+        history.setStderr(p.rule.Name, p.stderr)
+    }
+
+    if attempts > 0 {
+        runHooks(hookAfter, p, err, duration)
+    }
+    return err
+}
+
+// executeWithRetries runs a prepared rule, trying it again with a growing
+// delay while it fails and has retries left. It returns the number of
+// attempts and the error of the last one.
+func executeWithRetries(i int, p *preparedRule) (int, error) {
+    var err error
+    attempts := 0
+    delay := p.backoff
+    for {
+        attempts++
+        if attempts > 1 && p.output != nil {
+            fmt.Fprintf(p.output, "--- attempt %d ---\n", attempts)
+        }
+        err = executeCommand(p)
+        if err == nil {
+            break
         }
 
-        logDetails := fmt.Sprintf("Command: \"%s\", Result: %s in %v", command, result, duration)
-        err = logEvent("EXECUTE_COMMAND", logDetails)
+        if timeoutErr, ok := err.(*timeoutError); ok {
+            logWarning(writeLog(logEntry{Event: "EXECUTE_TIMEOUT", Rule: p.rule.Name, Command: p.command,
+                Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Timeout: %v", p.command, attempts, timeoutErr.timeout)}))
+        }
+        if limitErr, ok := err.(*limitError); ok {
+            logWarning(writeLog(logEntry{Event: "EXECUTE_LIMIT", Rule: p.rule.Name, Command: p.command,
+                Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Limit: %s", p.command, attempts, limitErr.limit)}))
+        } else if limits := undetectedLimits(p.rule); len(limits) > 0 && !stoppedByBaby(err) {
+            // The failure may come from one of these limits, the log says
+            // so instead of showing an ordinary failure
+            logWarning(writeLog(logEntry{Event: "EXECUTE_LIMIT_UNKNOWN", Rule: p.rule.Name, Command: p.command, Result: "possible limit",
+                Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Limits: %s, Result: Error: %v", p.command, attempts, strings.Join(limits, ", "), err)}))
+        }
+        if signalErr, ok := err.(*signalError); ok {
+            logWarning(writeLog(logEntry{Event: "EXECUTE_SIGNAL", Rule: p.rule.Name, Command: p.command,
+                Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Signal: %v", p.command, attempts, signalErr.signal)}))
+            break
+        }
+        if attempts > p.retries {
+            break
+        }
+
+        fmt.Printf("Attempt %d of command %d failed: %s\n", attempts, i+1, err)
+        fmt.Printf("Retrying in %v...\n", delay)
+        logWarning(writeLog(logEntry{Event: "EXECUTE_ATTEMPT", Rule: p.rule.Name, Command: p.command,
+            Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Result: Error: %v, Retry in %v", p.command, attempts, err, delay)}))
+        if sig := sleepInterruptible(delay); sig != nil {
+            err = &signalError{signal: sig}
+            logWarning(writeLog(logEntry{Event: "EXECUTE_SIGNAL", Rule: p.rule.Name, Command: p.command,
+                Details: fmt.Sprintf("Command: \"%s\", Attempt: %d, Signal: %v", p.command, attempts, sig)}))
+            break
+        }
+        delay *= 2
+    }
+    return attempts, err
+}
+
+// stoppedByBaby reports whether a command failed because baby stopped it,
+// for a timeout or a signal.
+func stoppedByBaby(err error) bool {
+    switch err.(type) {
+    case *timeoutError, *signalError:
+        return true
+    }
+    return false
+}
+
+func logWarning(err error) {
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+}
+
+// dangerousPatterns are commands that destroy data or act with elevated
+// rights. A rule whose expanded command matches any of them needs to be
+// confirmed before it runs.
+var dangerousPatterns = []struct {
+    re     *regexp.Regexp
+    reason string
+}{
+    {regexp.MustCompile(`\brm\s+(-\S*\s+)*-\S*[rRf]`), "rm with -r or -f"},
+    {regexp.MustCompile(`\bdd\s+.*\bof=`), "dd writing to a file or device"},
+    {regexp.MustCompile(`\bmkfs(\.\w+)?\b`), "mkfs"},
+    {regexp.MustCompile(`\b(wipefs|shred)\b`), "wipefs or shred"},
+    {regexp.MustCompile(`>\s*/dev/(sd|nvme|vd|hd|mmcblk)`), "redirect to a disk device"},
+    {regexp.MustCompile(`\bkubectl\s+(.*\s)?delete\b`), "kubectl delete"},
+    {regexp.MustCompile(`\bsudo\b`), "sudo"},
+    {regexp.MustCompile(`\b(shutdown|reboot|poweroff|halt)\b`), "shutdown or reboot"},
+    {regexp.MustCompile(`\bgit\s+push\s+(.*\s)?(-f|--force)\b`), "git push --force"},
+    {regexp.MustCompile(`\bchmod\s+(-\S+\s+)*-\S*R\S*\s+\S+\s+/(\s|$)`), "recursive chmod of /"},
+}
+
+// confirmationReasons explains why a prepared rule needs to be confirmed.
+// It returns nothing when the rule can run straight away.
+func confirmationReasons(p *preparedRule) []string {
+    var reasons []string
+    if p.rule.option("confirm") == "true" {
+        reasons = append(reasons, "the rule is marked to be confirmed")
+    }
+    var dangers []string
+    for _, pattern := range dangerousPatterns {
+        if pattern.re.MatchString(p.command) {
+            dangers = append(dangers, pattern.reason)
+        }
+    }
+    if len(dangers) > 0 {
+        reasons = append(reasons, "the command uses "+strings.Join(dangers, ", "))
+    }
+    return reasons
+}
+
+// confirmRule shows the final command of a rule that needs confirmation
+// and asks the user to type the rule name or y. Rules that don't need it,
+// or runs with --yes, are confirmed right away.
+func confirmRule(p *preparedRule, opts runOptions) bool {
+    reasons := confirmationReasons(p)
+    if len(reasons) == 0 || opts.yes {
+        return true
+    }
+
+    fmt.Printf("Rule '%s' needs confirmation because %s.\n", p.rule.Name, strings.Join(reasons, " and "))
+    fmt.Printf("Command: %s\n", p.command)
+    if opts.noPrompt {
+        fmt.Println("Nobody can confirm it in this run, use --yes to run it anyway.")
+        return false
+    }
+    fmt.Printf("Type '%s' or y to run it, anything else cancels (use --yes to skip this): ", p.rule.Name)
+    var response string
+    fmt.Scanln(&response)
+    return response == "y" || response == p.rule.Name
+}
+
+// preparedRule is a rule whose bottles have been filled and whose working
+// directory and environment are ready to be handed to executeCommand.
+type preparedRule struct {
+    rule       *Rule
+    command    string
+    dir        string
+    env        []string
+    before     []string
+    after      []string
+    conditions []condition
+    // output receives a copy of the command's output when it is captured
+    output     *os.File
+    timeout    time.Duration
+    retries    int
+    backoff    time.Duration
+    // inputs and outputs are the file patterns of the rule for baby build
+    inputs     []string
+    outputs    []string
+    // parallel is set when the rule runs next to other rules and can't
+    // have the terminal to itself
+    parallel   bool
+    // steps replace the command of rules made of steps
+    steps      []ruleStep
+    // bottles are the values of the rule's bottles, answers included
+    bottles    map[string]string
+    // usage collects the resource usage of every process the rule ran
+    usage      *resourceUsage
+    limits     ruleLimits
+    // sandbox runs the command in namespaces, without its hooks
+    sandbox    bool
+    // record receives what the command shows when the run is recorded
+    record     *castRecorder
+    // stderr keeps the end of the standard error for the run reports
+    stderr     *tailBuffer
+}
+
+func prepareRule(rule *Rule, bottleValues map[string]string, opts runOptions) (*preparedRule, error) {
+    // The rule gets its own copy of the bottles, what is answered for it
+    // isn't reused by the next rules of the run
+    values := make(map[string]string)
+    for name, value := range opts.ruleBottles[rule.Name] {
+        values[name] = value
+    }
+    for name, value := range bottleValues {
+        values[name] = value
+    }
+    bottleValues = values
+
+    if opts.noPrompt {
+        if missing := unfilledBottles(rule, bottleValues); len(missing) > 0 {
+            return nil, fmt.Errorf("rule '%s' needs a value for the bottles: %s. Set them with -b=<variable:value>",
+                rule.Name, strings.Join(missing, ", "))
+        }
+    }
+
+    command, _ := selectVariant(rule)
+    if rule.Options["step"] != nil {
+        // The command of a rule made of steps is only its description
+        command = ""
+    }
+    p := &preparedRule{
+        rule:    rule,
+        command: processBottles(command, bottleValues),
+        timeout: opts.timeout,
+        backoff: defaultBackoff,
+        sandbox: opts.sandbox,
+        bottles: bottleValues,
+    }
+
+    var err error
+    if value := rule.option("timeout"); value != "" && p.timeout == 0 {
+        // Imported rules don't go through validateRuleOption
+        if p.timeout, err = time.ParseDuration(value); err != nil || p.timeout <= 0 {
+            return nil, fmt.Errorf("invalid timeout '%s' in rule '%s'", value, rule.Name)
+        }
+    }
+    if value := rule.option("retries"); value != "" {
+        if p.retries, err = strconv.Atoi(value); err != nil || p.retries < 0 {
+            return nil, fmt.Errorf("invalid retries '%s' in rule '%s'", value, rule.Name)
+        }
+    }
+    if value := rule.option("backoff"); value != "" {
+        if p.backoff, err = time.ParseDuration(value); err != nil || p.backoff <= 0 {
+            return nil, fmt.Errorf("invalid backoff '%s' in rule '%s'", value, rule.Name)
+        }
+    }
+
+    if cwd := rule.option("cwd"); cwd != "" {
+        p.dir = expandHome(processBottles(cwd, bottleValues))
+        info, err := os.Stat(p.dir)
+        if err != nil || !info.IsDir() {
+            return nil, fmt.Errorf("working directory '%s' of rule '%s' not found", p.dir, rule.Name)
+        }
+    }
+
+    var extraEnv []string
+    if envFile := rule.option("envfile"); envFile != "" {
+        envFile = expandHome(processBottles(envFile, bottleValues))
+        if !filepath.IsAbs(envFile) && p.dir != "" {
+            envFile = filepath.Join(p.dir, envFile)
+        }
+        vars, err := readEnvFile(envFile)
         if err != nil {
-            fmt.Printf("Warning: Failed to log event: %v\n", err)
+            return nil, fmt.Errorf("failed to load env file of rule '%s': %v", rule.Name, err)
+        }
+        extraEnv = append(extraEnv, vars...)
+    }
+    for _, env := range rule.Options["env"] {
+        if !strings.Contains(env, "=") {
+            return nil, fmt.Errorf("invalid environment variable '%s' in rule '%s', it should be NAME=value", env, rule.Name)
         }
+        extraEnv = append(extraEnv, processBottles(env, bottleValues))
     }
+    if len(extraEnv) > 0 {
+        p.env = append(os.Environ(), extraEnv...)
+    }
+
+    for _, hook := range rule.Options["before"] {
+        p.before = append(p.before, processBottles(hook, bottleValues))
+    }
+    for _, hook := range rule.Options["after"] {
+        p.after = append(p.after, processBottles(hook, bottleValues))
+    }
+    for _, c := range ruleConditions(rule) {
+        p.conditions = append(p.conditions, condition{key: c.key, value: processBottles(c.value, bottleValues)})
+    }
+    if p.limits, err = parseRuleLimits(rule); err != nil {
+        return nil, err
+    }
+
+    steps, err := ruleSteps(rule)
+    if err != nil {
+        return nil, err
+    }
+    if len(steps) > 0 {
+        var commands []string
+        for _, step := range steps {
+            step.command = processBottles(step.command, bottleValues)
+            p.steps = append(p.steps, step)
+            commands = append(commands, step.command)
+        }
+        // The joined steps are what the rule runs, e.g. for the
+        // confirmation checks and the log
+        p.command = strings.Join(commands, " && ")
+    }
+    for _, pattern := range ruleList(rule, "inputs") {
+        p.inputs = append(p.inputs, processBottles(pattern, bottleValues))
+    }
+    for _, pattern := range ruleList(rule, "outputs") {
+        p.outputs = append(p.outputs, processBottles(pattern, bottleValues))
+    }
+    // The expanded commands end up in baby.log and its sinks
+    hideSecretsInLog(bottleValues)
+
+    return p, nil
 }
 
+// readEnvFile reads NAME=value pairs from a .env style file. Blank lines,
+// comments and an optional "export " prefix are accepted, and values may
+// be wrapped in single or double quotes.
+func readEnvFile(path string) ([]string, error) {
+    lines, err := readLines(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var vars []string
+    for n, line := range lines {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        line = strings.TrimPrefix(line, "export ")
+        parts := strings.SplitN(line, "=", 2)
+        if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+            return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n+1)
+        }
+        value := strings.TrimSpace(parts[1])
+        if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+            value = value[1 : len(value)-1]
+        }
+        vars = append(vars, strings.TrimSpace(parts[0])+"="+value)
+    }
+    return vars, nil
+}
+
+func expandHome(path string) string {
+    if path == "~" || strings.HasPrefix(path, "~/") {
+        if homeDir, err := os.UserHomeDir(); err == nil {
+            return filepath.Join(homeDir, path[1:])
+        }
+    }
+    return path
+}
+
+// getCommand returns the command a rule runs on this machine, taking its
+// distribution variants into account.
 func getCommand(name string) (string, error) {
-    file, err := os.Open(configFile)
+    rule, err := loadRule(name)
     if err != nil {
-        return "", fmt.Errorf("failed to open the configuration file: %v", err)
+        return "", err
     }
-    defer file.Close()
+    command, _ := selectVariant(rule)
+    return command, nil
+}
 
-    scanner := bufio.NewScanner(file)
-    for scanner.Scan() {
-        line := scanner.Text()
-        if strings.HasPrefix(line, name+" = ") {
-            return strings.TrimSpace(strings.TrimPrefix(line, name+" = ")), nil
+// Rule is a stored rule together with the options saved next to it in
+// baby.conf as "<name>.<key> = <value>" lines.
+type Rule struct {
+    Name    string
+    Command string
+    Options map[string][]string
+}
+
+// option returns the last value stored for key, or "" if it is not set.
+func (r *Rule) option(key string) string {
+    values := r.Options[key]
+    if len(values) == 0 {
+        return ""
+    }
+    return values[len(values)-1]
+}
+
+// ruleOptionKeys lists the options a rule can carry. Keys marked as multi
+// valued may appear several times, the rest are replaced when set again.
+var ruleOptionKeys = map[string]bool{
+    "cwd":      false,
+    "env":      true,
+    "envfile":  false,
+    "timeout":  false,
+    "retries":  false,
+    "backoff":  false,
+    "schedule": false,
+    "catchup":  false,
+    "confirm":  false,
+    "before":   true,
+    "after":    true,
+    "if-file":  true,
+    "if-bin":   true,
+    "if-host":  true,
+    "if-user":  true,
+    "if-check": true,
+    "on-unmet": false,
+    "capture":  false,
+    "pty":      false,
+    "needs":    true,
+    "inputs":   true,
+    "outputs":  true,
+    "step":     true,
+
+    "limit-cpu":     false,
+    "limit-as":      false,
+    "limit-files":   false,
+    "limit-procs":   false,
+    "cgroup-memory": false,
+    "cgroup-cpu":    false,
+}
+
+func isRuleOptionKey(key string) bool {
+    if strings.HasPrefix(key, variantPrefix) {
+        return len(key) > len(variantPrefix) && !strings.ContainsAny(key, " =")
+    }
+    _, ok := ruleOptionKeys[key]
+    return ok
+}
+
+// splitOptionName splits the left side of an option line such as
+// "deploy.cwd" into the rule name and the option key. key is empty when
+// lhs is a plain rule name.
+func splitOptionName(lhs string) (name, key string) {
+    for i := 1; i < len(lhs)-1; i++ {
+        if lhs[i] == '.' && isRuleOptionKey(lhs[i+1:]) {
+            return lhs[:i], lhs[i+1:]
         }
     }
+    return lhs, ""
+}
 
-    if err := scanner.Err(); err != nil {
-        return "", fmt.Errorf("error reading the configuration file: %v", err)
+// parseConfigLine parses a line of baby.conf. key is empty for rule lines
+// and holds the option key for option lines.
+func parseConfigLine(line string) (name, key, value string, ok bool) {
+    parts := strings.SplitN(line, " = ", 2)
+    if len(parts) != 2 {
+        return "", "", "", false
+    }
+    name, key = splitOptionName(strings.TrimSpace(parts[0]))
+    return name, key, strings.TrimSpace(parts[1]), true
+}
+
+// loadRules reads every rule in baby.conf in the order they are stored.
+func loadRules() ([]*Rule, error) {
+    lines, err := readLines(configFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open the configuration file: %v", err)
+    }
+
+    var rules []*Rule
+    byName := make(map[string]*Rule)
+    for _, line := range lines {
+        name, key, value, ok := parseConfigLine(line)
+        if !ok || key != "" {
+            continue
+        }
+        rule := &Rule{Name: name, Command: value, Options: make(map[string][]string)}
+        rules = append(rules, rule)
+        byName[name] = rule
+    }
+    for _, line := range lines {
+        name, key, value, ok := parseConfigLine(line)
+        if !ok || key == "" {
+            continue
+        }
+        if rule, found := byName[name]; found {
+            rule.Options[key] = append(rule.Options[key], value)
+        }
+    }
+    // A rule made before a built-in command took its name can't be run by
+    // it anymore. The warning goes to stderr, baby graph prints DOT.
+    reservedWarning.Do(func() {
+        for _, rule := range rules {
+            if isReservedName(rule.Name) {
+                fmt.Fprintf(os.Stderr, "Warning: Rule '%s' has the name of a built-in command, 'baby %s' runs the command. "+
+                    "Rename it in %s, on the line '%s = ...' and its '%s.<option>' lines.\n", rule.Name, rule.Name, configFile, rule.Name, rule.Name)
+            }
+        }
+    })
+    return rules, nil
+}
+
+func loadRule(name string) (*Rule, error) {
+    rules, err := loadRules()
+    if err != nil {
+        return nil, err
+    }
+    for _, rule := range rules {
+        if rule.Name == name {
+            return rule, nil
+        }
     }
+    return nil, fmt.Errorf("rule '%s' not found", name)
+}
 
-    return "", fmt.Errorf("rule '%s' not found", name)
+// ruleOptionLines returns the option lines of a rule formatted as they are
+// stored in baby.conf.
+func ruleOptionLines(rule *Rule) []string {
+    var lines []string
+    for _, key := range sortedOptionKeys(rule) {
+        for _, value := range rule.Options[key] {
+            lines = append(lines, fmt.Sprintf("%s.%s = %s", rule.Name, key, value))
+        }
+    }
+    return lines
+}
+
+func sortedOptionKeys(rule *Rule) []string {
+    var keys []string
+    for key := range rule.Options {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// setOptionLine stores an option line for a rule in lines. Single valued
+// options replace the previous value, multi valued ones are appended
+// unless the same value is already stored. An empty value removes the
+// option.
+func setOptionLine(lines []string, name, key, value string) []string {
+    var result []string
+    insertAt := -1
+    for _, line := range lines {
+        lineName, lineKey, lineValue, ok := parseConfigLine(line)
+        if ok && lineName == name {
+            if lineKey == key && (value == "" || !ruleOptionKeys[key] || lineValue == value) {
+                continue
+            }
+            result = append(result, line)
+            insertAt = len(result)
+            continue
+        }
+        result = append(result, line)
+    }
+    if value == "" || insertAt < 0 {
+        return result
+    }
+
+    newLine := fmt.Sprintf("%s.%s = %s", name, key, value)
+    result = append(result[:insertAt], append([]string{newLine}, result[insertAt:]...)...)
+    return result
+}
+
+// validateRuleOption checks a value before it is stored for key, so
+// mistakes show up when setting the option instead of when running it.
+func validateRuleOption(key, value string) error {
+    switch key {
+    case "env":
+        if !strings.Contains(value, "=") {
+            return fmt.Errorf("'%s' should be NAME=value", value)
+        }
+    case "timeout", "backoff":
+        if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+            return fmt.Errorf("'%s' is not a duration, e.g. 30s or 5m", value)
+        }
+    case "retries":
+        if n, err := strconv.Atoi(value); err != nil || n < 0 {
+            return fmt.Errorf("'%s' is not a positive number", value)
+        }
+    case "schedule":
+        if _, err := parseSchedule(value); err != nil {
+            return err
+        }
+    case "catchup", "confirm", "capture":
+        if value != "true" && value != "false" {
+            return fmt.Errorf("'%s' should be true or false", value)
+        }
+    case "on-unmet":
+        if value != "skip" && value != "fail" {
+            return fmt.Errorf("'%s' should be skip or fail", value)
+        }
+    case "pty":
+        if value != "auto" && value != "true" && value != "false" {
+            return fmt.Errorf("'%s' should be auto, true or false", value)
+        }
+    case "needs":
+        for _, name := range splitList(value) {
+            if isReservedName(name) {
+                return fmt.Errorf("'%s' is not a rule name", name)
+            }
+        }
+    case "step":
+        if _, err := parseStep(value); err != nil {
+            return err
+        }
+    case "limit-cpu", "limit-as", "limit-files", "limit-procs", "cgroup-memory", "cgroup-cpu":
+        return validateLimit(key, value)
+    case "inputs", "outputs":
+        for _, pattern := range splitList(value) {
+            if _, err := filepath.Match(pattern, ""); err != nil {
+                return fmt.Errorf("'%s' is not a valid pattern", pattern)
+            }
+        }
+    }
+    return nil
+}
+
+func setRuleOption(name, key, value string) {
+    if !isRuleOptionKey(key) {
+        fmt.Printf("Unknown rule option '%s'. Use baby -h to see the available options.\n", key)
+        return
+    }
+    if !ruleExists(name) {
+        fmt.Printf("Rule '%s' not found.\n", name)
+        return
+    }
+    if value != "" {
+        if err := validateRuleOption(key, value); err != nil {
+            fmt.Printf("Invalid value for option '%s': %v\n", key, err)
+            return
+        }
+    }
+
+    lines, err := readLines(configFile)
+    if err != nil {
+        fmt.Println("Error reading the configuration file:", err)
+        return
+    }
+
+    lines = setOptionLine(lines, name, key, value)
+    err = writeLinesWithLock(configFile, lines)
+    if err != nil {
+        fmt.Println("Error writing to the configuration file:", err)
+        return
+    }
+
+    // write events in baby.log
+    err = writeLog(logEntry{Event: "SET_OPTION", Rule: name, Details: fmt.Sprintf("Name: %s, Option: %s, Value: %s", name, key, optionLogValue(key, value))})
+    if err != nil {
+        fmt.Printf("Warning: Failed to log event: %v\n", err)
+    }
+
+    if value == "" {
+        fmt.Printf("Option '%s' removed from rule '%s'.\n", key, name)
+    } else {
+        fmt.Printf("Option '%s' of rule '%s' set to: %s\n", key, name, value)
+    }
 }
 
 func importRulesFromFile(filePath string) {
@@ -452,9 +1580,12 @@ func importRulesFromFile(filePath string) {
         return
     }
 
+    // Rules the user chose not to overwrite, their options are skipped too
+    skipped := make(map[string]bool)
+
     // Process rules
     for _, rule := range rules {
-        parts := strings.Split(rule, " = ")
+        parts := strings.SplitN(rule, " = ", 2)
         if len(parts) != 2 {
             fmt.Println("Error parsing rule:", rule)
             continue
@@ -462,6 +1593,19 @@ func importRulesFromFile(filePath string) {
         name := strings.TrimSpace(parts[0])
         command := strings.TrimSpace(parts[1])
 
+        if ruleName, key := splitOptionName(name); key != "" {
+            if skipped[ruleName] {
+                continue
+            }
+            existingRules = setOptionLine(existingRules, ruleName, key, command)
+            err := writeLog(logEntry{Event: "IMPORT_RULE", Rule: ruleName,
+                Details: fmt.Sprintf("From File: %s, Name: %s, Option: %s, Value: %s", filePath, ruleName, key, optionLogValue(key, command))})
+            if err != nil {
+                fmt.Printf("Warning: Failed to log event: %v\n", err)
+            }
+            continue
+        }
+
         // Check if the rule already exists
         exists := false
         for i, existingRule := range existingRules {
@@ -475,6 +1619,7 @@ func importRulesFromFile(filePath string) {
                     fmt.Printf("Rule '%s' updated.\n", name)
                 } else {
                     fmt.Printf("Skipping rule '%s'.\n", name)
+                    skipped[name] = true
                 }
                 break
             }
@@ -486,7 +1631,8 @@ func importRulesFromFile(filePath string) {
         }
 
         // Log the import event
-        err := logEvent("IMPORT_RULE", fmt.Sprintf("From File: %s, Name: %s, Command: %s", filePath, name, command))
+        err := writeLog(logEntry{Event: "IMPORT_RULE", Rule: name, Command: command,
+            Details: fmt.Sprintf("From File: %s, Name: %s, Command: %s", filePath, name, command)})
         if err != nil {
             fmt.Printf("Warning: Failed to log event: %v\n", err)
         }
@@ -575,12 +1721,15 @@ func exportRules() {
     }
 
     for _, rule := range exportRules {
-        command, err := getCommand(rule)
+        r, err := loadRule(rule)
         if err != nil {
             fmt.Printf("Error getting command for rule '%s': %v\n", rule, err)
             continue
         }
-        exportContent = append(exportContent, fmt.Sprintf("b:%s = %s:b", rule, command))
+        exportContent = append(exportContent, fmt.Sprintf("b:%s = %s:b", rule, r.Command))
+        for _, line := range ruleOptionLines(r) {
+            exportContent = append(exportContent, fmt.Sprintf("b:%s:b", line))
+        }
     }
 
     for {
@@ -654,7 +1803,10 @@ func getAllRules() []string {
         line := scanner.Text()
         parts := strings.SplitN(line, "=", 2)
         if len(parts) == 2 {
-            rules = append(rules, strings.TrimSpace(parts[0]))
+            name := strings.TrimSpace(parts[0])
+            if _, key := splitOptionName(name); key == "" {
+                rules = append(rules, name)
+            }
         }
     }
 
@@ -686,24 +1838,282 @@ func writeToFile(filePath string, content []string) error {
     return nil
 }
 
-func executeCommand(command string) error {
-    cmd := exec.Command("bash", "-c", command)
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
+// timeoutError is returned by executeCommand when the command ran for
+// longer than its timeout and had to be stopped.
+type timeoutError struct {
+    timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+    return fmt.Sprintf("command timed out after %v", e.timeout)
+}
+
+// signalError is returned by executeCommand when the command was stopped
+// by SIGINT or SIGTERM, either from the terminal or forwarded by baby.
+type signalError struct {
+    signal os.Signal
+}
+
+func (e *signalError) Error() string {
+    return fmt.Sprintf("command interrupted by %v", e.signal)
+}
+
+func executeCommand(p *preparedRule) error {
+    cmd := exec.Command("bash", "-c", p.command)
+    var cgroup *transientCgroup
+    if !p.limits.empty() {
+        var err error
+        if cmd, cgroup, err = limitedCommand(p); err != nil {
+            return err
+        }
+        if cgroup != nil {
+            defer cgroup.remove()
+        }
+    }
+    var box *sandbox
+    if p.sandbox {
+        var err error
+        if cmd, box, err = sandboxedCommand(cmd); err != nil {
+            return err
+        }
+        defer box.finish(p)
+    }
+    cmd.Dir = p.dir
+    cmd.Env = p.env
+    var stdout, stderr io.Writer = os.Stdout, os.Stderr
+    if p.record != nil {
+        stdout, stderr = io.MultiWriter(os.Stdout, p.record), io.MultiWriter(os.Stderr, p.record)
+    }
     cmd.Stdin = os.Stdin
+    if p.parallel {
+        // Rules running side by side share the terminal: their lines are
+        // prefixed with the rule name and they can't read from it
+        prefixed := &prefixWriter{w: stdout, prefix: "[" + p.rule.Name + "] "}
+        defer prefixed.Flush()
+        stdout, stderr = prefixed, prefixed
+        cmd.Stdin = nil
+    }
+    cmd.Stdout = stdout
+    cmd.Stderr = stderr
+    if p.output != nil {
+        cmd.Stdout = io.MultiWriter(stdout, p.output)
+        cmd.Stderr = io.MultiWriter(stderr, p.output)
+    }
+    if p.stderr != nil {
+        cmd.Stderr = io.MultiWriter(cmd.Stderr, p.stderr)
+    }
+
+    // Run the command in its own process group so signals and timeouts
+    // reach every process it starts. When baby owns the terminal the group
+    // is moved to the foreground so interactive commands keep working.
+    foreground := !p.parallel && isForegroundTerminal(int(os.Stdin.Fd()))
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    var terminal *ptyRelay
+    if usePTY(p) {
+        // On a pseudo-terminal of its own the command keeps its colours and
+        // prompts while baby copies its output
+        var err error
+        if terminal, err = openPTY(); err != nil {
+            fmt.Printf("Warning: The command runs without a terminal: %v\n", err)
+        } else {
+            terminal.attach(cmd, p.parallel)
+            foreground = false
+        }
+    }
+    if foreground {
+        cmd.SysProcAttr.Foreground = true
+        cmd.SysProcAttr.Ctty = int(os.Stdin.Fd())
+    }
+    if box != nil {
+        sandboxAttr(cmd.SysProcAttr)
+    }
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    defer signal.Stop(signals)
 
-    err := cmd.Run()
+    err := cmd.Start()
     if err != nil {
-        if exitError, ok := err.(*exec.ExitError); ok {
-            return fmt.Errorf("command failed with exit code %d: %v", exitError.ExitCode(), err)
+        if terminal != nil {
+            terminal.finish()
         }
         return fmt.Errorf("failed to execute command: %v", err)
     }
-    return nil
+    if foreground {
+        defer reclaimTerminal(int(os.Stdin.Fd()))
+    }
+    if terminal != nil {
+        out := stdout
+        if p.output != nil {
+            out = io.MultiWriter(stdout, p.output)
+        }
+        // A terminal mixes both streams, the reports get all of it as
+        // the output of the rule
+        if p.stderr != nil {
+            p.stderr.merged = true
+            out = io.MultiWriter(out, p.stderr)
+        }
+        terminal.start(out, !p.parallel)
+        defer terminal.finish()
+    }
+    pgid := cmd.Process.Pid
+
+    done := make(chan error, 1)
+    go func() {
+        done <- cmd.Wait()
+    }()
+
+    var timeout <-chan time.Time
+    if p.timeout > 0 {
+        timer := time.NewTimer(p.timeout)
+        defer timer.Stop()
+        timeout = timer.C
+    }
+
+    var interruption error
+    var kill <-chan time.Time
+    for {
+        select {
+        case err := <-done:
+            p.usage.add(cmd.ProcessState)
+            // A command that traps the signal and exits cleanly was still
+            // stopped by the timeout or the user
+            if interruption != nil {
+                return interruption
+            }
+            return limitBreach(p, cgroup, cmd.ProcessState, commandError(err))
+        case <-timeout:
+            fmt.Printf("Command timed out after %v, sending SIGTERM\n", p.timeout)
+            interruption = &timeoutError{timeout: p.timeout}
+            unix.Kill(-pgid, unix.SIGTERM)
+            kill = time.After(killGracePeriod)
+            timeout = nil
+        case sig := <-signals:
+            if interruption == nil {
+                interruption = &signalError{signal: sig}
+            }
+            unix.Kill(-pgid, sig.(syscall.Signal))
+            if sig == syscall.SIGTERM && kill == nil {
+                kill = time.After(killGracePeriod)
+            }
+        case <-kill:
+            fmt.Printf("Command still running after %v, sending SIGKILL\n", killGracePeriod)
+            unix.Kill(-pgid, unix.SIGKILL)
+            kill = nil
+        }
+    }
+}
+
+// commandError turns the result of cmd.Wait into the error reported for
+// the command.
+func commandError(err error) error {
+    if err == nil {
+        return nil
+    }
+    if exitError, ok := err.(*exec.ExitError); ok {
+        if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+            sig := status.Signal()
+            if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+                return &signalError{signal: sig}
+            }
+            return fmt.Errorf("command terminated by signal %v", sig)
+        }
+        return &exitCodeError{code: exitError.ExitCode(), err: err}
+    }
+    return fmt.Errorf("failed to execute command: %v", err)
+}
+
+// exitCodeError is returned by executeCommand when the command exited with
+// a non-zero status.
+type exitCodeError struct {
+    code int
+    err  error
+}
+
+func (e *exitCodeError) Error() string {
+    return fmt.Sprintf("command failed with exit code %d: %v", e.code, e.err)
+}
+
+// exitCodeOf maps the error of a run to a shell style exit code.
+func exitCodeOf(err error) int {
+    switch e := err.(type) {
+    case nil:
+        return 0
+    case *exitCodeError:
+        return e.code
+    case *timeoutError:
+        // Same code as timeout(1)
+        return 124
+    case *signalError:
+        return 128 + int(e.signal.(syscall.Signal))
+    case *limitError:
+        return exitCodeOf(e.err)
+    }
+    return 1
+}
+
+// isForegroundTerminal reports whether fd is a terminal whose foreground
+// process group is baby's own.
+func isForegroundTerminal(fd int) bool {
+    pgrp, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+    return err == nil && pgrp == unix.Getpgrp()
+}
+
+// reclaimTerminal moves baby's process group back to the foreground of the
+// terminal once a command that owned it has finished.
+func reclaimTerminal(fd int) {
+    signal.Ignore(syscall.SIGTTOU)
+    defer signal.Reset(syscall.SIGTTOU)
+    unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, unix.Getpgrp())
+}
+
+// sleepInterruptible waits for d and returns the signal that cut the wait
+// short, if any.
+func sleepInterruptible(d time.Duration) os.Signal {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    defer signal.Stop(signals)
+
+    select {
+    case <-time.After(d):
+        return nil
+    case sig := <-signals:
+        return sig
+    }
+}
+
+var bottleRegexp = regexp.MustCompile(`b%\('([^']+)'\)%b`)
+
+// unfilledBottles lists the bottles used by a rule that have no value yet.
+func unfilledBottles(rule *Rule, bottleValues map[string]string) []string {
+    command, _ := selectVariant(rule)
+    texts := []string{command, rule.option("cwd"), rule.option("envfile")}
+    texts = append(texts, rule.Options["env"]...)
+    texts = append(texts, rule.Options["before"]...)
+    texts = append(texts, rule.Options["after"]...)
+    texts = append(texts, rule.Options["step"]...)
+    texts = append(texts, rule.Options["inputs"]...)
+    texts = append(texts, rule.Options["outputs"]...)
+    for _, c := range ruleConditions(rule) {
+        texts = append(texts, c.value)
+    }
+
+    var missing []string
+    seen := make(map[string]bool)
+    for _, text := range texts {
+        for _, match := range bottleRegexp.FindAllStringSubmatch(text, -1) {
+            name := match[1]
+            if _, ok := bottleValues[name]; !ok && !seen[name] {
+                missing = append(missing, name)
+                seen[name] = true
+            }
+        }
+    }
+    return missing
 }
 
 func processBottles(command string, bottleValues map[string]string) string {
-    re := regexp.MustCompile(`b%\('([^']+)'\)%b`)
+    re := bottleRegexp
     return re.ReplaceAllStringFunc(command, func(match string) string {
         bottleName := re.FindStringSubmatch(match)[1]
         if value, ok := bottleValues[bottleName]; ok {
@@ -712,6 +2122,10 @@ func processBottles(command string, bottleValues map[string]string) string {
         fmt.Printf("The %s is?: ", bottleName)
         var value string
         fmt.Scanln(&value)
+        // Remember the answer so the rule's directory and environment
+        // don't ask for the same bottle again. prepareRule gives every
+        // rule its own map.
+        bottleValues[bottleName] = value
         return value
     })
 }
@@ -754,35 +2168,6 @@ func writeLines(filename string, lines []string) error {
     return writer.Flush()
 }
 
-func logEvent(eventType, details string) error {
-    logPath := filepath.Join(os.Getenv("HOME"), logDir, logFileName)
-
-    err := os.MkdirAll(filepath.Dir(logPath), 0755)
-    if err != nil {
-        return fmt.Errorf("failed to create log directory: %v", err)
-    }
-
-    file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        return fmt.Errorf("failed to open log file: %v", err)
-    }
-    defer file.Close()
-
-    user := os.Getenv("USER")
-    timestamp := time.Now().Format("2006-01-02 15:04:05")
-    ip := getIP()
-
-    logMessage := fmt.Sprintf("[%s] %s %s at %s | %s\n", // i.e User:%s
-                              timestamp, eventType, user, ip, details)
-
-    _, err = file.WriteString(logMessage)
-    if err != nil {
-        return fmt.Errorf("failed to write to log file: %v", err)
-    }
-
-    return nil
-}
-
 func initConfigFile() error {
     homeDir, err := os.UserHomeDir()
     if err != nil {
@@ -813,20 +2198,23 @@ func initConfigFile() error {
     return nil
 }
 
-func getIP() string {
-    addrs, err := net.InterfaceAddrs()
-    if err == nil {
-        for _, addr := range addrs {
-            if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-                if ipnet.IP.To4() != nil {
-                    return ipnet.IP.String()
-                }
-            }
-        }
+// babyStateDir returns a directory under ~/.local/state/baby, creating it
+// if needed.
+func babyStateDir(name string) (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %v", err)
+    }
+    dir := filepath.Join(homeDir, stateDir, name)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return "", fmt.Errorf("failed to create state directory: %v", err)
     }
-    return "Unknown IP"
+    return dir, nil
 }
 
+// reservedWarning reports the rules with a reserved name once per run.
+var reservedWarning sync.Once
+
 func isReservedName(name string) bool {
     for _, reserved := range reservedNames {
         if name == reserved {
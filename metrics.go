@@ -0,0 +1,213 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// defaultMetricBuckets are the upper bounds of the duration histogram.
+var defaultMetricBuckets = []time.Duration{
+    100 * time.Millisecond, time.Second, 5 * time.Second, 30 * time.Second,
+    time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour,
+}
+
+// ruleMetrics are the counters of a rule kept between runs in
+// metrics/metrics.json of the state directory. Buckets are not cumulative,
+// the textfile adds them up.
+type ruleMetrics struct {
+    Runs        int64     `json:"runs"`
+    Failures    int64     `json:"failures"`
+    LastSuccess time.Time `json:"last_success"`
+    Buckets     []int64   `json:"buckets"`
+    Sum         float64   `json:"sum"`
+    Count       int64     `json:"count"`
+}
+
+type metricsState struct {
+    // Bounds are the buckets the histograms were counted with, in seconds
+    Bounds []float64               `json:"bounds"`
+    Rules  map[string]*ruleMetrics `json:"rules"`
+}
+
+// metricBuckets reads metrics.buckets, durations separated by commas.
+func metricBuckets() ([]float64, error) {
+    buckets := defaultMetricBuckets
+    if value := getSetting("metrics.buckets", ""); value != "" {
+        buckets = nil
+        for _, item := range splitList(value) {
+            d, err := time.ParseDuration(item)
+            if err != nil || d <= 0 {
+                return nil, fmt.Errorf("invalid metrics.buckets: '%s' is not a duration", item)
+            }
+            buckets = append(buckets, d)
+        }
+    }
+    var bounds []float64
+    for _, d := range buckets {
+        bounds = append(bounds, d.Seconds())
+    }
+    sort.Float64s(bounds)
+    return bounds, nil
+}
+
+// updateMetrics adds the rules executed by a run to the counters and
+// rewrites the textfile of metrics.textfile for the node_exporter textfile
+// collector. Nothing happens when the setting is empty.
+func updateMetrics(results []HistoryResult) {
+    path := getSetting("metrics.textfile", "")
+    if path == "" {
+        return
+    }
+    if err := writeMetrics(expandHome(path), results); err != nil {
+        fmt.Printf("Warning: Failed to update the metrics: %v\n", err)
+    }
+}
+
+func writeMetrics(path string, results []HistoryResult) error {
+    bounds, err := metricBuckets()
+    if err != nil {
+        return err
+    }
+    dir, err := babyStateDir("metrics")
+    if err != nil {
+        return err
+    }
+    statePath := filepath.Join(dir, "metrics.json")
+
+    // Runs that finish at the same time would lose each other's counts
+    lock, err := os.OpenFile(statePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+    if err != nil {
+        return err
+    }
+    defer lock.Close()
+    if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+        return err
+    }
+    defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+    state := metricsState{Rules: make(map[string]*ruleMetrics)}
+    if data, err := os.ReadFile(statePath); err == nil {
+        if err := json.Unmarshal(data, &state); err != nil {
+            return fmt.Errorf("failed to read %s: %v", statePath, err)
+        }
+    }
+    if state.Rules == nil {
+        state.Rules = make(map[string]*ruleMetrics)
+    }
+    // Histograms counted with other buckets start over
+    sameBounds := len(state.Bounds) == len(bounds)
+    for i := 0; sameBounds && i < len(bounds); i++ {
+        sameBounds = state.Bounds[i] == bounds[i]
+    }
+    if !sameBounds {
+        state.Bounds = bounds
+        for _, m := range state.Rules {
+            m.Buckets, m.Sum, m.Count = nil, 0, 0
+        }
+    }
+
+    for _, r := range results {
+        // Rules that were skipped, declined or not found didn't run
+        if r.Status != "success" && r.Status != "failed" && r.Status != "limit exceeded" {
+            continue
+        }
+        m := state.Rules[r.Rule]
+        if m == nil {
+            m = &ruleMetrics{}
+            state.Rules[r.Rule] = m
+        }
+        if len(m.Buckets) != len(bounds) {
+            m.Buckets = make([]int64, len(bounds))
+        }
+        m.Runs++
+        if r.Status == "success" {
+            m.LastSuccess = time.Now()
+        } else {
+            m.Failures++
+        }
+        for i, bound := range bounds {
+            if r.Duration <= bound {
+                m.Buckets[i]++
+                break
+            }
+        }
+        m.Sum += r.Duration
+        m.Count++
+    }
+
+    data, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(statePath+".tmp", data, 0600); err != nil {
+        return err
+    }
+    if err := os.Rename(statePath+".tmp", statePath); err != nil {
+        return err
+    }
+
+    // The collector may read the file at any time, it is replaced at once
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, []byte(formatMetrics(state)), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// formatMetrics writes the counters in the Prometheus text format.
+func formatMetrics(state metricsState) string {
+    var names []string
+    for name := range state.Rules {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    label := func(name string) string {
+        return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(name)
+    }
+    number := func(f float64) string {
+        return strconv.FormatFloat(f, 'g', -1, 64)
+    }
+
+    var b strings.Builder
+    b.WriteString("# HELP baby_rule_runs_total Executions of the rule.\n")
+    b.WriteString("# TYPE baby_rule_runs_total counter\n")
+    for _, name := range names {
+        fmt.Fprintf(&b, "baby_rule_runs_total{rule=\"%s\"} %d\n", label(name), state.Rules[name].Runs)
+    }
+    b.WriteString("# HELP baby_rule_failures_total Executions of the rule that failed.\n")
+    b.WriteString("# TYPE baby_rule_failures_total counter\n")
+    for _, name := range names {
+        fmt.Fprintf(&b, "baby_rule_failures_total{rule=\"%s\"} %d\n", label(name), state.Rules[name].Failures)
+    }
+    b.WriteString("# HELP baby_rule_last_success_timestamp_seconds Time of the last successful execution of the rule.\n")
+    b.WriteString("# TYPE baby_rule_last_success_timestamp_seconds gauge\n")
+    for _, name := range names {
+        if m := state.Rules[name]; !m.LastSuccess.IsZero() {
+            fmt.Fprintf(&b, "baby_rule_last_success_timestamp_seconds{rule=\"%s\"} %d\n", label(name), m.LastSuccess.Unix())
+        }
+    }
+    b.WriteString("# HELP baby_rule_duration_seconds Duration of the executions of the rule.\n")
+    b.WriteString("# TYPE baby_rule_duration_seconds histogram\n")
+    for _, name := range names {
+        m := state.Rules[name]
+        var cumulative int64
+        for i, bound := range state.Bounds {
+            if i < len(m.Buckets) {
+                cumulative += m.Buckets[i]
+            }
+            fmt.Fprintf(&b, "baby_rule_duration_seconds_bucket{rule=\"%s\",le=\"%s\"} %d\n", label(name), number(bound), cumulative)
+        }
+        fmt.Fprintf(&b, "baby_rule_duration_seconds_bucket{rule=\"%s\",le=\"+Inf\"} %d\n", label(name), m.Count)
+        fmt.Fprintf(&b, "baby_rule_duration_seconds_sum{rule=\"%s\"} %s\n", label(name), number(m.Sum))
+        fmt.Fprintf(&b, "baby_rule_duration_seconds_count{rule=\"%s\"} %d\n", label(name), m.Count)
+    }
+    return b.String()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+const (
+    outputDirName = "output"
+    // Default retention of captured outputs
+    defaultOutputKeep   = 500
+    defaultOutputMaxAge = 30 * 24 * time.Hour
+)
+
+// newRunID returns the ID of a run of baby, which links the log entries of
+// the run to its captured outputs. It starts with the time, so IDs sort by
+// age.
+func newRunID() string {
+    suffix := make([]byte, 2)
+    rand.Read(suffix)
+    return time.Now().Format("20060102-150405.000") + "-" + hex.EncodeToString(suffix)
+}
+
+func outputDir() (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %v", err)
+    }
+    dir := filepath.Join(homeDir, logDir, outputDirName)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return "", fmt.Errorf("failed to create output directory: %v", err)
+    }
+    return dir, nil
+}
+
+// captureEnabled reports whether the output of a rule is captured. The
+// output.capture setting turns it off for every rule and the capture
+// option for a single one.
+func captureEnabled(rule *Rule) bool {
+    if rule.option("capture") == "false" {
+        return false
+    }
+    return getBoolSetting("output.capture", true)
+}
+
+// runOutput is the file where the output of one rule of a run is kept.
+// Its name is <run id>_<position>_<rule>.log.
+type runOutput struct {
+    runID string
+    index int
+    rule  string
+    path  string
+}
+
+func outputFileName(runID string, index int, rule string) string {
+    // Rule names may contain anything but a slash is not valid in a name
+    return fmt.Sprintf("%s_%d_%s.log", runID, index, strings.ReplaceAll(rule, "/", "%2F"))
+}
+
+// parseOutputFileName reads an output file name back. ok is false for
+// files that don't belong to the archive.
+func parseOutputFileName(name string) (out runOutput, ok bool) {
+    if !strings.HasSuffix(name, ".log") {
+        return out, false
+    }
+    parts := strings.SplitN(strings.TrimSuffix(name, ".log"), "_", 3)
+    if len(parts) != 3 {
+        return out, false
+    }
+    if _, err := fmt.Sscanf(parts[1], "%d", &out.index); err != nil {
+        return out, false
+    }
+    out.runID = parts[0]
+    out.rule = strings.ReplaceAll(parts[2], "%2F", "/")
+    return out, true
+}
+
+// createRunOutput creates the output file of a rule of a run.
+func createRunOutput(runID string, index int, rule string) (*os.File, error) {
+    dir, err := outputDir()
+    if err != nil {
+        return nil, err
+    }
+    path := filepath.Join(dir, outputFileName(runID, index, rule))
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create output file: %v", err)
+    }
+    return file, nil
+}
+
+// listRunOutputs returns the captured outputs, oldest first. An empty rule
+// returns the outputs of every rule.
+func listRunOutputs(rule string) ([]runOutput, error) {
+    dir, err := outputDir()
+    if err != nil {
+        return nil, err
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    var outputs []runOutput
+    for _, entry := range entries {
+        out, ok := parseOutputFileName(entry.Name())
+        if !ok || (rule != "" && out.rule != rule) {
+            continue
+        }
+        out.path = filepath.Join(dir, entry.Name())
+        outputs = append(outputs, out)
+    }
+    sort.Slice(outputs, func(i, j int) bool {
+        if outputs[i].runID != outputs[j].runID {
+            return outputs[i].runID < outputs[j].runID
+        }
+        return outputs[i].index < outputs[j].index
+    })
+    return outputs, nil
+}
+
+// pruneRunOutputs applies the retention limits of the archive: outputs
+// older than output.max-age are removed, and only the newest output.keep
+// are kept.
+func pruneRunOutputs() {
+    outputs, err := listRunOutputs("")
+    if err != nil {
+        return
+    }
+    keep := getIntSetting("output.keep", defaultOutputKeep)
+    maxAge := getDurationSetting("output.max-age", defaultOutputMaxAge)
+
+    for i, out := range outputs {
+        if keep > 0 && len(outputs)-i > keep {
+            os.Remove(out.path)
+            continue
+        }
+        if info, err := os.Stat(out.path); err == nil && maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+            os.Remove(out.path)
+        }
+    }
+}
+
+// showRunOutputs prints the last captured outputs of a rule.
+func showRunOutputs(rule string, last int) {
+    outputs, err := listRunOutputs(rule)
+    if err != nil {
+        fmt.Println("Error reading the output archive:", err)
+        return
+    }
+    if len(outputs) == 0 {
+        fmt.Printf("No captured output for rule '%s'.\n", rule)
+        return
+    }
+    if last > 0 && len(outputs) > last {
+        outputs = outputs[len(outputs)-last:]
+    }
+
+    for _, out := range outputs {
+        content, err := os.ReadFile(out.path)
+        if err != nil {
+            fmt.Println("Error reading the output:", err)
+            continue
+        }
+        started := out.runID
+        if info, err := os.Stat(out.path); err == nil {
+            started = info.ModTime().Format("2006-01-02 15:04:05")
+        }
+        fmt.Printf("=== Rule '%s', run %s, %s ===\n", out.rule, out.runID, started)
+        os.Stdout.Write(content)
+        if len(content) > 0 && content[len(content)-1] != '\n' {
+            fmt.Println()
+        }
+    }
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// ptyDrainTimeout is how long the output of a command is still read after
+// it exits, for processes it left behind on the terminal.
+const ptyDrainTimeout = 200 * time.Millisecond
+
+// usePTY reports whether the command of a rule runs on a pseudo-terminal.
+// The pty option forces it on or off, by default it is used when baby
+// would otherwise hide the terminal from the command by copying or
+// prefixing its output, and when the run is recorded.
+func usePTY(p *preparedRule) bool {
+    switch p.rule.option("pty") {
+    case "true":
+        return true
+    case "false":
+        return false
+    }
+    if p.record != nil {
+        return true
+    }
+    return (p.output != nil || p.parallel) && isTerminal(int(os.Stdout.Fd()))
+}
+
+func isTerminal(fd int) bool {
+    _, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+    return err == nil
+}
+
+// ptyRelay is a pseudo-terminal the command of a rule runs on. baby copies
+// what the command writes to the terminal to its output and, when it owns
+// the terminal, what the user types to the command.
+type ptyRelay struct {
+    master *os.File
+    slave  *os.File
+    // restore is the state of baby's terminal before it was made raw
+    restore *unix.Termios
+    // stop wakes up the input relay when the command is done
+    stop   [2]int
+    input  bool
+    copied chan struct{}
+    winch  chan os.Signal
+}
+
+// openPTY opens a new pseudo-terminal through /dev/ptmx.
+func openPTY() (*ptyRelay, error) {
+    master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open /dev/ptmx: %v", err)
+    }
+    fd := int(master.Fd())
+    if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+        master.Close()
+        return nil, fmt.Errorf("failed to unlock the pseudo-terminal: %v", err)
+    }
+    n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+    if err != nil {
+        master.Close()
+        return nil, fmt.Errorf("failed to find the pseudo-terminal: %v", err)
+    }
+    slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY, 0)
+    if err != nil {
+        master.Close()
+        return nil, fmt.Errorf("failed to open the pseudo-terminal: %v", err)
+    }
+    r := &ptyRelay{master: master, slave: slave, stop: [2]int{-1, -1}}
+    r.resize()
+    return r, nil
+}
+
+// attach makes the pseudo-terminal the controlling terminal and the
+// output of cmd. Its input is the terminal too, unless the command runs
+// next to other rules.
+func (r *ptyRelay) attach(cmd *exec.Cmd, parallel bool) {
+    cmd.Stdout = r.slave
+    cmd.Stderr = r.slave
+    if !parallel {
+        cmd.Stdin = r.slave
+    }
+    // The command gets its own session, which also makes it the leader of
+    // its process group for signals and timeouts
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 1}
+}
+
+// start relays the output of the started command to out, and the input
+// of baby's terminal to the command when relayInput is set.
+func (r *ptyRelay) start(out io.Writer, relayInput bool) {
+    r.slave.Close()
+
+    r.copied = make(chan struct{})
+    go func() {
+        // Reading fails with EIO once nothing has the terminal open
+        io.Copy(out, r.master)
+        close(r.copied)
+    }()
+
+    r.winch = make(chan os.Signal, 1)
+    signal.Notify(r.winch, syscall.SIGWINCH)
+    go func(winch chan os.Signal) {
+        for range winch {
+            r.resize()
+        }
+    }(r.winch)
+
+    stdin := int(os.Stdin.Fd())
+    if !relayInput || !isForegroundTerminal(stdin) {
+        return
+    }
+    var p [2]int
+    if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+        return
+    }
+    r.stop = p
+    r.input = true
+    // The keys go to the command as they are typed, ctrl+c included
+    if termios, err := unix.IoctlGetTermios(stdin, unix.TCGETS); err == nil {
+        raw := *termios
+        raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+        raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+        raw.Cflag &^= unix.CSIZE | unix.PARENB
+        raw.Cflag |= unix.CS8
+        raw.Cc[unix.VMIN] = 1
+        raw.Cc[unix.VTIME] = 0
+        if unix.IoctlSetTermios(stdin, unix.TCSETS, &raw) == nil {
+            r.restore = termios
+        }
+    }
+    go r.relayInput(stdin)
+}
+
+// relayInput copies what is typed on baby's terminal to the command until
+// the stop pipe is closed.
+func (r *ptyRelay) relayInput(stdin int) {
+    defer unix.Close(r.stop[0])
+    buf := make([]byte, 4096)
+    fds := []unix.PollFd{{Fd: int32(stdin), Events: unix.POLLIN}, {Fd: int32(r.stop[0]), Events: unix.POLLIN}}
+    for {
+        if _, err := unix.Poll(fds, -1); err != nil {
+            if err == unix.EINTR {
+                continue
+            }
+            return
+        }
+        if fds[1].Revents != 0 || fds[0].Revents&unix.POLLIN == 0 {
+            return
+        }
+        n, err := unix.Read(stdin, buf)
+        if err != nil || n <= 0 {
+            return
+        }
+        if _, err := r.master.Write(buf[:n]); err != nil {
+            return
+        }
+    }
+}
+
+// resize gives the pseudo-terminal the size of baby's terminal.
+func (r *ptyRelay) resize() {
+    for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stdin.Fd())} {
+        if size, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+            unix.IoctlSetWinsize(int(r.master.Fd()), unix.TIOCSWINSZ, size)
+            return
+        }
+    }
+}
+
+// finish waits for the rest of the output once the command exited and
+// gives baby's terminal back its state.
+func (r *ptyRelay) finish() {
+    if r.copied != nil {
+        select {
+        case <-r.copied:
+        case <-time.After(ptyDrainTimeout):
+        }
+        signal.Stop(r.winch)
+        close(r.winch)
+    }
+    if r.input {
+        // Closing the write end wakes up the input relay
+        unix.Close(r.stop[1])
+    }
+    if r.restore != nil {
+        unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, r.restore)
+    }
+    r.slave.Close()
+    r.master.Close()
+}
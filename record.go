@@ -0,0 +1,251 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+
+    "golang.org/x/sys/unix"
+)
+
+const recordingsDirName = "recordings"
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+    Version   int               `json:"version"`
+    Width     int               `json:"width"`
+    Height    int               `json:"height"`
+    Timestamp int64             `json:"timestamp"`
+    Command   string            `json:"command,omitempty"`
+    Title     string            `json:"title,omitempty"`
+    Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder writes what a run shows in the terminal to an asciicast v2
+// file, as [seconds, "o", data] events. Rules running side by side write
+// to it at the same time.
+type castRecorder struct {
+    mu    sync.Mutex
+    file  *os.File
+    w     *bufio.Writer
+    start time.Time
+    // pending holds the start of a UTF-8 character split between writes
+    pending []byte
+    lastCR  bool
+}
+
+func recordingsDir() (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("failed to get home directory: %v", err)
+    }
+    dir := filepath.Join(homeDir, logDir, recordingsDirName)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return "", fmt.Errorf("failed to create recordings directory: %v", err)
+    }
+    return dir, nil
+}
+
+// newCastRecorder creates the recording of a run. Without a path it goes
+// to the recordings directory, named after the run ID.
+func newCastRecorder(path, runID string, rules []string) (*castRecorder, error) {
+    if path == "" {
+        dir, err := recordingsDir()
+        if err != nil {
+            return nil, err
+        }
+        path = filepath.Join(dir, runID+".cast")
+    }
+    file, err := os.OpenFile(expandHome(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create the recording: %v", err)
+    }
+
+    header := castHeader{
+        Version:   2,
+        Width:     80,
+        Height:    24,
+        Timestamp: time.Now().Unix(),
+        Command:   "baby " + strings.Join(rules, " "),
+        Title:     "baby run " + runID,
+        Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+    }
+    if size, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && size.Col > 0 {
+        header.Width, header.Height = int(size.Col), int(size.Row)
+    }
+    r := &castRecorder{file: file, w: bufio.NewWriter(file), start: time.Now()}
+    data, _ := json.Marshal(header)
+    r.w.Write(append(data, '\n'))
+    return r, nil
+}
+
+// Write adds an output event. Line feeds without a carriage return are
+// completed like a terminal would, so output that didn't go through a
+// pseudo-terminal plays back right.
+func (r *castRecorder) Write(p []byte) (int, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    data := append(r.pending, p...)
+    // Only whole characters are written, JSON strings can't hold the rest
+    cut := len(data)
+    for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+        if utf8.RuneStart(data[i]) {
+            if !utf8.FullRune(data[i:]) {
+                cut = i
+            }
+            break
+        }
+    }
+    r.pending = append([]byte(nil), data[cut:]...)
+
+    var out strings.Builder
+    for _, b := range data[:cut] {
+        if b == '\n' && !r.lastCR {
+            out.WriteByte('\r')
+        }
+        out.WriteByte(b)
+        r.lastCR = b == '\r'
+    }
+    if out.Len() > 0 {
+        r.event("o", out.String())
+    }
+    return len(p), nil
+}
+
+// marker adds a marker event, players use them to jump to a rule.
+func (r *castRecorder) marker(label string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.event("m", label)
+}
+
+func (r *castRecorder) event(kind, data string) {
+    event, _ := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, data})
+    r.w.Write(append(event, '\n'))
+}
+
+// close writes the end of the recording and returns where it is.
+func (r *castRecorder) close() (string, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if len(r.pending) > 0 {
+        r.event("o", string(r.pending))
+    }
+    err := r.w.Flush()
+    if closeErr := r.file.Close(); err == nil {
+        err = closeErr
+    }
+    return r.file.Name(), err
+}
+
+// parseReplayArgs reads the arguments of baby replay.
+func parseReplayArgs(args []string) (path string, speed float64, idle time.Duration, ok bool) {
+    speed = 1
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--speed" && i+1 < len(args):
+            s, err := strconv.ParseFloat(args[i+1], 64)
+            if err != nil || s <= 0 {
+                return "", 0, 0, false
+            }
+            speed = s
+            i++
+        case args[i] == "--idle" && i+1 < len(args):
+            d, err := time.ParseDuration(args[i+1])
+            if err != nil || d <= 0 {
+                return "", 0, 0, false
+            }
+            idle = d
+            i++
+        case strings.HasPrefix(args[i], "-") || path != "":
+            return "", 0, 0, false
+        default:
+            path = args[i]
+        }
+    }
+    return path, speed, idle, path != ""
+}
+
+// replayRecording plays an asciicast v2 file in the terminal. speed
+// divides the pauses between events and idle, when set, caps them.
+func replayRecording(path string, speed float64, idle time.Duration) error {
+    file, err := os.Open(expandHome(path))
+    if err != nil {
+        return fmt.Errorf("failed to open the recording: %v", err)
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    if !scanner.Scan() {
+        return fmt.Errorf("%s is empty", path)
+    }
+    var header castHeader
+    if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+        return fmt.Errorf("%s is not an asciicast v2 recording", path)
+    }
+
+    start := time.Now()
+    var elapsed, previous float64
+    for line := 2; scanner.Scan(); line++ {
+        var event []interface{}
+        if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+            return fmt.Errorf("invalid event on line %d of %s", line, path)
+        }
+        at, ok1 := event[0].(float64)
+        kind, ok2 := event[1].(string)
+        data, ok3 := event[2].(string)
+        if !ok1 || !ok2 || !ok3 {
+            return fmt.Errorf("invalid event on line %d of %s", line, path)
+        }
+
+        pause := (at - previous) / speed
+        previous = at
+        if idle > 0 && pause > idle.Seconds() {
+            pause = idle.Seconds()
+        }
+        elapsed += pause
+        // Waiting for the time since the start keeps the delays of many
+        // small events from adding up
+        time.Sleep(time.Until(start.Add(time.Duration(elapsed * float64(time.Second)))))
+        if kind == "o" {
+            os.Stdout.WriteString(data)
+        }
+    }
+    return scanner.Err()
+}
+
+// startRecording starts the recording of a run when --record was given. A
+// recording that can't be created only gets a warning.
+func startRecording(opts runOptions, runID string, rules []string) *castRecorder {
+    if !opts.record {
+        return nil
+    }
+    recorder, err := newCastRecorder(opts.recordPath, runID, rules)
+    if err != nil {
+        fmt.Printf("Warning: The run won't be recorded: %v\n", err)
+        return nil
+    }
+    return recorder
+}
+
+func finishRecording(recorder *castRecorder, runID string) {
+    if recorder == nil {
+        return
+    }
+    path, err := recorder.close()
+    if err != nil {
+        fmt.Printf("Warning: Failed to save the recording: %v\n", err)
+        return
+    }
+    logWarning(logEvent("RECORDING_SAVED", fmt.Sprintf("Path: %s, Run: %s", path, runID)))
+    fmt.Printf("Recording saved to %s, play it with 'baby replay %s'\n", path, path)
+}
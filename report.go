@@ -0,0 +1,229 @@
+package main
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+)
+
+// maxReportStderr is how much of the end of a rule's standard error a
+// report keeps.
+const maxReportStderr = 64 * 1024
+
+// runReport is a file given with --report <format>=<path>, written at the
+// end of the run.
+type runReport struct {
+    format string
+    path   string
+}
+
+// parseReport reads the value of --report: junit=<path> or json=<path>.
+func parseReport(value string) (runReport, error) {
+    format, path, ok := strings.Cut(value, "=")
+    if !ok || path == "" || (format != "junit" && format != "json") {
+        return runReport{}, fmt.Errorf("'%s' should be junit=<file> or json=<file>", value)
+    }
+    return runReport{format: format, path: path}, nil
+}
+
+// tailBuffer keeps the last bytes written to it. merged is set when it
+// gets the standard output of the command as well.
+type tailBuffer struct {
+    mu     sync.Mutex
+    buf    []byte
+    max    int
+    merged bool
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.buf = append(t.buf, p...)
+    if len(t.buf) > t.max {
+        t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+    }
+    return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return string(t.buf)
+}
+
+// reportRule is a rule of a JSON report.
+type reportRule struct {
+    Name     string  `json:"name"`
+    Status   string  `json:"status"`
+    Command  string  `json:"command,omitempty"`
+    ExitCode int     `json:"exit_code"`
+    Duration float64 `json:"duration"`
+    Error    string  `json:"error,omitempty"`
+    Stderr   string  `json:"stderr,omitempty"`
+    // Output replaces Stderr when the rule ran on a pseudo-terminal
+    Output   string  `json:"output,omitempty"`
+}
+
+type jsonReport struct {
+    RunID    string       `json:"run_id"`
+    Time     string       `json:"time"`
+    Build    bool         `json:"build,omitempty"`
+    ExitCode int          `json:"exit_code"`
+    Duration float64      `json:"duration"`
+    Tests    int          `json:"tests"`
+    Failures int          `json:"failures"`
+    Skipped  int          `json:"skipped"`
+    Rules    []reportRule `json:"rules"`
+}
+
+type junitSuites struct {
+    XMLName  xml.Name     `xml:"testsuites"`
+    Name     string       `xml:"name,attr"`
+    Tests    int          `xml:"tests,attr"`
+    Failures int          `xml:"failures,attr"`
+    Errors   int          `xml:"errors,attr"`
+    Skipped  int          `xml:"skipped,attr"`
+    Time     string       `xml:"time,attr"`
+    Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+    Name      string      `xml:"name,attr"`
+    Tests     int         `xml:"tests,attr"`
+    Failures  int         `xml:"failures,attr"`
+    Errors    int         `xml:"errors,attr"`
+    Skipped   int         `xml:"skipped,attr"`
+    Time      string      `xml:"time,attr"`
+    Timestamp string      `xml:"timestamp,attr"`
+    Hostname  string      `xml:"hostname,attr,omitempty"`
+    Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+    Name      string        `xml:"name,attr"`
+    Classname string        `xml:"classname,attr"`
+    Time      string        `xml:"time,attr"`
+    Failure   *junitMessage `xml:"failure,omitempty"`
+    Error     *junitMessage `xml:"error,omitempty"`
+    Skipped   *junitMessage `xml:"skipped,omitempty"`
+    SystemOut string        `xml:"system-out,omitempty"`
+    SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+    Message string `xml:"message,attr,omitempty"`
+    Type    string `xml:"type,attr,omitempty"`
+    Text    string `xml:",chardata"`
+}
+
+// setOutput adds what was kept of the output of a rule to its test case.
+// On a pseudo-terminal standard error can't be told apart from the rest.
+func (c *junitCase) setOutput(r HistoryResult) {
+    if r.merged {
+        c.SystemOut = r.stderr
+    } else {
+        c.SystemErr = r.stderr
+    }
+}
+
+// reportOutcome sorts the status of a rule into the outcomes of a test:
+// passed, failed, error when it couldn't run and skipped.
+func reportOutcome(status string) string {
+    switch status {
+    case "success":
+        return "passed"
+    case "failed", "limit exceeded":
+        return "failed"
+    case "not run", "declined":
+        return "error"
+    }
+    return "skipped"
+}
+
+func junitSeconds(f float64) string {
+    return fmt.Sprintf("%.3f", f)
+}
+
+// writeReports writes the reports of a run, a report that can't be written
+// only gets a warning.
+func writeReports(reports []runReport, h *HistoryEntry) {
+    for _, report := range reports {
+        var data []byte
+        var err error
+        if report.format == "junit" {
+            data, err = junitReport(h)
+        } else {
+            data, err = jsonRunReport(h)
+        }
+        if err == nil {
+            err = os.WriteFile(expandHome(report.path), data, 0644)
+        }
+        if err != nil {
+            fmt.Printf("Warning: Failed to write the %s report: %v\n", report.format, err)
+        }
+    }
+}
+
+func jsonRunReport(h *HistoryEntry) ([]byte, error) {
+    report := jsonReport{RunID: h.ID, Time: h.Time.Format("2006-01-02T15:04:05Z07:00"), Build: h.Build,
+        ExitCode: h.ExitCode, Duration: h.Duration, Rules: []reportRule{}}
+    for _, r := range h.Results {
+        rule := reportRule{Name: r.Rule, Status: r.Status, Command: r.Command, ExitCode: r.ExitCode,
+            Duration: r.Duration, Error: r.Error}
+        switch reportOutcome(r.Status) {
+        case "failed", "error":
+            report.Failures++
+            if r.merged {
+                rule.Output = r.stderr
+            } else {
+                rule.Stderr = r.stderr
+            }
+        case "skipped":
+            report.Skipped++
+        }
+        report.Tests++
+        report.Rules = append(report.Rules, rule)
+    }
+    data, err := json.MarshalIndent(report, "", "  ")
+    return append(data, '\n'), err
+}
+
+func junitReport(h *HistoryEntry) ([]byte, error) {
+    hostname, _ := os.Hostname()
+    suite := junitSuite{Name: "baby " + strings.Join(h.Rules, " "), Time: junitSeconds(h.Duration),
+        Timestamp: h.Time.Format("2006-01-02T15:04:05"), Hostname: hostname}
+    if h.Build {
+        suite.Name = "baby build " + strings.Join(h.Rules, " ")
+    }
+    for _, r := range h.Results {
+        c := junitCase{Name: r.Rule, Classname: "baby", Time: junitSeconds(r.Duration)}
+        message := &junitMessage{Message: r.Error, Type: r.Status}
+        switch reportOutcome(r.Status) {
+        case "failed":
+            message.Text = fmt.Sprintf("Command: %s\nExit code: %d", r.Command, r.ExitCode)
+            c.Failure = message
+            c.setOutput(r)
+            suite.Failures++
+        case "error":
+            c.Error = message
+            c.setOutput(r)
+            suite.Errors++
+        case "skipped":
+            message.Message = r.Status
+            c.Skipped = message
+            suite.Skipped++
+        }
+        suite.Tests++
+        suite.Cases = append(suite.Cases, c)
+    }
+    suites := junitSuites{Name: "baby", Tests: suite.Tests, Failures: suite.Failures, Errors: suite.Errors,
+        Skipped: suite.Skipped, Time: suite.Time, Suites: []junitSuite{suite}}
+    data, err := xml.MarshalIndent(suites, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    return append([]byte(xml.Header), append(data, '\n')...), nil
+}
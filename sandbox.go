@@ -0,0 +1,247 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/fs"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// sandboxTargets are the directories a sandboxed rule sees through an
+// overlay: it can write to them, but the writes go to a scratch directory
+// that is thrown away after the run. The home directory is added to them,
+// everything else is read-only.
+var sandboxTargets = []string{"/tmp", "/var/tmp", "/dev/shm"}
+
+// sandboxChange is a file a sandboxed rule tried to change.
+type sandboxChange struct {
+    Path   string `json:"path"`
+    Change string `json:"change"`
+}
+
+type sandboxReport struct {
+    Changes []sandboxChange `json:"changes"`
+    Error   string          `json:"error,omitempty"`
+}
+
+// sandboxReportFd is where "baby __sandbox" writes its report for baby.
+const sandboxReportFd = 3
+
+// sandbox is a run of a command in the sandbox: the scratch directory
+// that holds the overlays and the file the report is written to.
+type sandbox struct {
+    scratch string
+    report  *os.File
+}
+
+// sandboxedCommand wraps a command in "baby __sandbox", which starts in
+// new user, mount and network namespaces, mounts the overlays and runs the
+// command.
+func sandboxedCommand(cmd *exec.Cmd) (*exec.Cmd, *sandbox, error) {
+    executable, err := os.Executable()
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to find the baby executable: %v", err)
+    }
+    dir, err := babyStateDir("sandbox")
+    if err != nil {
+        return nil, nil, err
+    }
+    scratch, err := os.MkdirTemp(dir, "run-")
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to create the sandbox: %v", err)
+    }
+    report, err := os.CreateTemp(dir, "report-")
+    if err != nil {
+        os.Remove(scratch)
+        return nil, nil, fmt.Errorf("failed to create the sandbox: %v", err)
+    }
+    os.Remove(report.Name())
+
+    args := append([]string{"__sandbox", scratch, cmd.Path}, cmd.Args...)
+    sandboxed := exec.Command(executable, args...)
+    sandboxed.ExtraFiles = []*os.File{report}
+    return sandboxed, &sandbox{scratch: scratch, report: report}, nil
+}
+
+// sandboxAttr adds the namespaces of the sandbox to the attributes of a
+// command. The user is root inside the sandbox, which only gives it rights
+// over the files the user owns.
+func sandboxAttr(attr *syscall.SysProcAttr) {
+    attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+    attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+    attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+    attr.GidMappingsEnableSetgroups = false
+}
+
+// finish prints the files the sandboxed rule tried to change, logs how
+// many there were and removes the sandbox.
+func (s *sandbox) finish(p *preparedRule) {
+    defer os.Remove(s.scratch)
+    defer s.report.Close()
+
+    var r sandboxReport
+    if _, err := s.report.Seek(0, 0); err != nil || json.NewDecoder(s.report).Decode(&r) != nil {
+        fmt.Println("Sandbox: no report of the changes was written.")
+        return
+    }
+    if r.Error != "" {
+        fmt.Printf("Sandbox: %s\n", r.Error)
+        return
+    }
+
+    logWarning(writeLog(logEntry{Event: "SANDBOX_REPORT", Rule: p.rule.Name,
+        Details: fmt.Sprintf("Name: %s, Changes: %d", p.rule.Name, len(r.Changes))}))
+    if len(r.Changes) == 0 {
+        fmt.Println("Sandbox: the rule didn't try to change any file.")
+        return
+    }
+    fmt.Printf("Sandbox: the rule tried to change %d file(s), none of them was changed:\n", len(r.Changes))
+    home, _ := os.UserHomeDir()
+    for _, change := range r.Changes {
+        path := change.Path
+        if home != "" && strings.HasPrefix(path, home+"/") {
+            path = "~" + strings.TrimPrefix(path, home)
+        }
+        fmt.Printf("  %-9s %s\n", change.Change, path)
+    }
+}
+
+// discard removes the sandbox without printing the changes. It returns the
+// error that kept the sandbox from starting, if any.
+func (s *sandbox) discard() string {
+    defer os.Remove(s.scratch)
+    defer s.report.Close()
+
+    var r sandboxReport
+    if _, err := s.report.Seek(0, 0); err == nil {
+        json.NewDecoder(s.report).Decode(&r)
+    }
+    return r.Error
+}
+
+// runSandbox is "baby __sandbox": it runs in the new namespaces, mounts
+// the overlays, runs the command and reports the files it changed in the
+// overlays.
+func runSandbox(scratch, path string, args []string) {
+    reportFile := os.NewFile(sandboxReportFd, "report")
+    unix.CloseOnExec(sandboxReportFd)
+    fail := func(format string, a ...interface{}) {
+        json.NewEncoder(reportFile).Encode(sandboxReport{Error: fmt.Sprintf(format, a...)})
+        fmt.Fprintf(os.Stderr, "baby: "+format+"\n", a...)
+        os.Exit(126)
+    }
+
+    // Nothing mounted here may show up outside the sandbox
+    if err := unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+        fail("failed to make the mounts private: %v", err)
+    }
+    // Outside of the overlays the rule can't write anything. A remount
+    // with MS_REC only changes the top mount, mount_setattr changes them
+    // all and keeps their other flags.
+    readOnly := &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}
+    if err := unix.MountSetattr(-1, "/", unix.AT_RECURSIVE, readOnly); err != nil {
+        fail("failed to make the file system read-only: %v", err)
+    }
+
+    targets := sandboxTargets
+    if home, err := os.UserHomeDir(); err == nil {
+        targets = append([]string{home}, targets...)
+    }
+    if err := unix.Mount("tmpfs", scratch, "tmpfs", 0, "mode=0700"); err != nil {
+        fail("failed to mount the scratch directory: %v", err)
+    }
+    // The scratch directory may be hidden by an overlay, it is reached
+    // through a descriptor from now on
+    scratchFd, err := unix.Open(scratch, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+    if err != nil {
+        fail("failed to open the scratch directory: %v", err)
+    }
+    scratchPath := fmt.Sprintf("/proc/self/fd/%d", scratchFd)
+
+    type overlay struct {
+        target string
+        lower  string
+        upper  string
+    }
+    var overlays []overlay
+    for i, target := range targets {
+        if info, err := os.Stat(target); err != nil || !info.IsDir() {
+            continue
+        }
+        lowerFd, err := unix.Open(target, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+        if err != nil {
+            fail("failed to open %s: %v", target, err)
+        }
+        upper := filepath.Join(scratchPath, fmt.Sprint(i), "upper")
+        work := filepath.Join(scratchPath, fmt.Sprint(i), "work")
+        os.MkdirAll(upper, 0700)
+        os.MkdirAll(work, 0700)
+        options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", target, upper, work)
+        if err := unix.Mount("overlay", target, "overlay", 0, options); err != nil {
+            fail("failed to mount the overlay on %s: %v", target, err)
+        }
+        overlays = append(overlays, overlay{target: target, lower: fmt.Sprintf("/proc/self/fd/%d", lowerFd), upper: upper})
+    }
+
+    // Signals reach the command through its process group, baby only has
+    // to stay alive to write the report
+    signal.Notify(make(chan os.Signal, 1), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+
+    // The working directory is still the one under the overlays, which is
+    // read-only now. Going there again by its path goes through them.
+    wd, err := os.Getwd()
+    if err != nil {
+        fail("failed to find the working directory: %v", err)
+    }
+    cmd := &exec.Cmd{Path: path, Args: args, Dir: wd, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+    runErr := cmd.Run()
+
+    var report sandboxReport
+    for _, o := range overlays {
+        filepath.WalkDir(o.upper, func(path string, entry fs.DirEntry, err error) error {
+            if err != nil || path == o.upper {
+                return nil
+            }
+            rel := strings.TrimPrefix(path, o.upper+"/")
+            change := sandboxChange{Path: filepath.Join(o.target, rel), Change: "created"}
+            info, err := entry.Info()
+            if err != nil {
+                return nil
+            }
+            _, lowerErr := os.Lstat(filepath.Join(o.lower, rel))
+            switch {
+            case info.Mode()&fs.ModeCharDevice != 0 && info.Sys().(*syscall.Stat_t).Rdev == 0:
+                // A 0/0 character device is how the overlay records a
+                // removed file
+                change.Change = "deleted"
+            case lowerErr == nil && entry.IsDir():
+                // Directories are copied up when something in them changes
+                return nil
+            case lowerErr == nil:
+                change.Change = "modified"
+            }
+            report.Changes = append(report.Changes, change)
+            return nil
+        })
+    }
+    json.NewEncoder(reportFile).Encode(report)
+
+    if runErr == nil {
+        os.Exit(0)
+    }
+    if exitErr, ok := runErr.(*exec.ExitError); ok {
+        if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+            os.Exit(128 + int(status.Signal()))
+        }
+        os.Exit(exitErr.ExitCode())
+    }
+    fmt.Fprintf(os.Stderr, "baby: %v\n", runErr)
+    os.Exit(127)
+}
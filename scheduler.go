@@ -0,0 +1,624 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+const (
+    // Longest the scheduler sleeps before reloading baby.conf
+    schedulerMaxSleep = time.Minute
+    // Runs later than this are reported as a catch-up of a missed run
+    schedulerLateness = time.Minute
+    // Number of captured outputs kept for every scheduled rule
+    schedulerKeepOutputs = 20
+)
+
+// schedule computes when a rule is due next.
+type schedule interface {
+    next(after time.Time) time.Time
+}
+
+// intervalSchedule is an "every <duration>" schedule.
+type intervalSchedule struct {
+    every time.Duration
+}
+
+func (s intervalSchedule) next(after time.Time) time.Time {
+    return after.Add(s.every)
+}
+
+// cronSchedule is a five field cron expression. Each field is stored as a
+// bitset of the values it matches.
+type cronSchedule struct {
+    minute, hour, dom, month, dow uint64
+    // A restricted day of month and day of week match either, like cron
+    domStar, dowStar bool
+}
+
+var cronMacros = map[string]string{
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly":  "0 0 1 * *",
+    "@weekly":   "0 0 * * 0",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly":   "0 * * * *",
+}
+
+// parseSchedule reads the schedule option of a rule: "every 15m", a cron
+// expression like "*/10 8-18 * * 1-5" or a macro like "@daily".
+func parseSchedule(spec string) (schedule, error) {
+    spec = strings.TrimSpace(spec)
+    if strings.HasPrefix(spec, "every ") {
+        every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "every ")))
+        if err != nil || every < time.Second {
+            return nil, fmt.Errorf("'%s' is not a valid interval, e.g. every 15m", spec)
+        }
+        return intervalSchedule{every: every}, nil
+    }
+    if macro, ok := cronMacros[spec]; ok {
+        spec = macro
+    }
+
+    fields := strings.Fields(spec)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("'%s' should be 'every <duration>' or a cron expression with 5 fields", spec)
+    }
+    var s cronSchedule
+    var err error
+    if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, fmt.Errorf("minute: %v", err)
+    }
+    if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, fmt.Errorf("hour: %v", err)
+    }
+    if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, fmt.Errorf("day of month: %v", err)
+    }
+    if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, fmt.Errorf("month: %v", err)
+    }
+    if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, fmt.Errorf("day of week: %v", err)
+    }
+    // Sunday can be written as 0 or 7
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domStar = fields[2] == "*"
+    s.dowStar = fields[4] == "*"
+    return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+// such as "1,15,30", "8-18" or "*/5".
+func parseCronField(field string, min, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("invalid step in '%s'", part)
+            }
+            step = n
+            part = part[:i]
+        }
+
+        low, high := min, max
+        switch {
+        case part == "*":
+        case strings.Contains(part, "-"):
+            bounds := strings.SplitN(part, "-", 2)
+            var err1, err2 error
+            low, err1 = strconv.Atoi(bounds[0])
+            high, err2 = strconv.Atoi(bounds[1])
+            if err1 != nil || err2 != nil {
+                return 0, fmt.Errorf("invalid range '%s'", part)
+            }
+        default:
+            n, err := strconv.Atoi(part)
+            if err != nil {
+                return 0, fmt.Errorf("invalid value '%s'", part)
+            }
+            low, high = n, n
+            if step > 1 {
+                high = max
+            }
+        }
+        if low < min || high > max || low > high {
+            return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+        }
+        for v := low; v <= high; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func (s cronSchedule) matchesDay(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    if s.domStar || s.dowStar {
+        return dom && dow
+    }
+    return dom || dow
+}
+
+func (s cronSchedule) next(after time.Time) time.Time {
+    t := nextMinute(after.Truncate(time.Minute))
+    // Give up after five years, the expression can never match
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        switch {
+        case s.month&(1<<uint(t.Month())) == 0:
+            t = wallTime(t, t.Year(), t.Month()+1, 1, 0)
+        case !s.matchesDay(t):
+            t = wallTime(t, t.Year(), t.Month(), t.Day()+1, 0)
+        case s.hour&(1<<uint(t.Hour())) == 0:
+            // Truncate works in UTC, it would miss the hours of zones that
+            // are half an hour off
+            t = wallTime(t, t.Year(), t.Month(), t.Day(), t.Hour()+1)
+        case s.minute&(1<<uint(t.Minute())) == 0:
+            t = nextMinute(t)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+// nextMinute returns the minute after t on the wall clock. The hour that
+// repeats when the clocks go back is skipped, the rules already ran in it.
+func nextMinute(t time.Time) time.Time {
+    next := t.Add(time.Minute)
+    if next.Day() == t.Day() && next.Hour()*60+next.Minute() < t.Hour()*60+t.Minute() {
+        return wallTime(t, t.Year(), t.Month(), t.Day(), t.Hour()+1)
+    }
+    return next
+}
+
+// wallTime returns the start of an hour on the wall clock of t, which
+// comes after t. An hour skipped when the clocks go forward can come out
+// of time.Date an hour early, before t, it is moved to the end of the gap.
+func wallTime(t time.Time, year int, month time.Month, day, hour int) time.Time {
+    next := time.Date(year, month, day, hour, 0, 0, 0, t.Location())
+    if !next.After(t) {
+        next = next.Add(time.Hour)
+    }
+    return next
+}
+
+// sendBottles gives bottle values to a baby child process through a pipe
+// it inherits and reads with --bottles-fd. On its command line they would
+// be visible to every user in /proc. started closes the end of the pipe
+// left to the child once cmd was started.
+func sendBottles(cmd *exec.Cmd, bottles map[string]string) (started func(), err error) {
+    if len(bottles) == 0 {
+        return func() {}, nil
+    }
+    data, err := json.Marshal(bottles)
+    if err != nil {
+        return nil, err
+    }
+    r, w, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+    // ExtraFiles start after stdin, stdout and stderr
+    cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+    cmd.Args = append(cmd.Args, fmt.Sprintf("--bottles-fd=%d", 2+len(cmd.ExtraFiles)))
+    // The pipe may not hold everything, the child reads it while it is
+    // written. If the child doesn't start, started closes the last reader
+    // and the write fails.
+    go func() {
+        w.Write(data)
+        w.Close()
+    }()
+    return func() { r.Close() }, nil
+}
+
+// readBottles reads the bottle values sent by sendBottles.
+func readBottles(value string, bottleValues map[string]string) error {
+    fd, err := strconv.Atoi(value)
+    if err != nil || fd < 3 {
+        return fmt.Errorf("'%s' is not a file descriptor", value)
+    }
+    file := os.NewFile(uintptr(fd), "bottles")
+    defer file.Close()
+    var bottles map[string]string
+    if err := json.NewDecoder(file).Decode(&bottles); err != nil {
+        return err
+    }
+    // Values given with -b win
+    for name, value := range bottles {
+        if _, ok := bottleValues[name]; !ok {
+            bottleValues[name] = value
+        }
+    }
+    return nil
+}
+
+// scheduleState is what the scheduler remembers about a rule between
+// restarts, so missed runs can be caught up.
+type scheduleState struct {
+    LastRun  time.Time `json:"last_run"`
+    LastExit int       `json:"last_exit"`
+    Output   string    `json:"output,omitempty"`
+}
+
+func scheduleStatePath() (string, error) {
+    dir, err := babyStateDir("scheduler")
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "state.json"), nil
+}
+
+func loadScheduleState() (map[string]*scheduleState, error) {
+    states := make(map[string]*scheduleState)
+    path, err := scheduleStatePath()
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return states, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &states); err != nil {
+        return nil, fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    return states, nil
+}
+
+func saveScheduleState(states map[string]*scheduleState) error {
+    path, err := scheduleStatePath()
+    if err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(states, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(path+".tmp", path)
+}
+
+// scheduledRule is a rule with a valid schedule option.
+type scheduledRule struct {
+    name    string
+    spec    string
+    sched   schedule
+    catchup bool
+}
+
+func loadScheduledRules() ([]scheduledRule, error) {
+    rules, err := loadRules()
+    if err != nil {
+        return nil, err
+    }
+    var scheduled []scheduledRule
+    for _, rule := range rules {
+        spec := rule.option("schedule")
+        if spec == "" {
+            continue
+        }
+        sched, err := parseSchedule(spec)
+        if err != nil {
+            fmt.Printf("Warning: Ignoring the schedule of rule '%s': %v\n", rule.Name, err)
+            continue
+        }
+        scheduled = append(scheduled, scheduledRule{
+            name:    rule.Name,
+            spec:    spec,
+            sched:   sched,
+            catchup: rule.option("catchup") != "false",
+        })
+    }
+    return scheduled, nil
+}
+
+// nextRun returns when a rule is due, based on its last run or on the
+// time the scheduler started if it never ran.
+func nextRun(rule scheduledRule, state *scheduleState, started time.Time) time.Time {
+    if state == nil || state.LastRun.IsZero() {
+        return rule.sched.next(started)
+    }
+    return rule.sched.next(state.LastRun)
+}
+
+// scheduler runs the rules that have a schedule option when they are due.
+type scheduler struct {
+    bottles map[string]string
+    yes     bool
+    started time.Time
+
+    mu      sync.Mutex
+    states  map[string]*scheduleState
+    running map[string]*exec.Cmd
+    // skipped remembers the last due time skipped because the previous
+    // run was still going
+    skipped map[string]time.Time
+    wg      sync.WaitGroup
+}
+
+// runScheduler is the foreground daemon started with baby scheduler. It is
+// meant to be supervised, e.g. by a systemd user unit.
+func runScheduler(bottleValues map[string]string, opts runOptions) {
+    dir, err := babyStateDir("scheduler")
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+
+    // Only one scheduler may run at a time, or rules would run twice
+    lock, err := os.OpenFile(filepath.Join(dir, "scheduler.lock"), os.O_RDWR|os.O_CREATE, 0600)
+    if err != nil {
+        fmt.Println("Error opening the scheduler lock:", err)
+        return
+    }
+    defer lock.Close()
+    if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+        fmt.Println("Error: Another baby scheduler is already running.")
+        return
+    }
+
+    states, err := loadScheduleState()
+    if err != nil {
+        fmt.Println("Error reading the scheduler state:", err)
+        return
+    }
+    s := &scheduler{
+        bottles: bottleValues,
+        yes:     opts.yes,
+        started: time.Now(),
+        states:  states,
+        running: make(map[string]*exec.Cmd),
+        skipped: make(map[string]time.Time),
+    }
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+    defer signal.Stop(signals)
+
+    fmt.Println("Baby scheduler started. Press ctrl+c to quit")
+    logWarning(logEvent("SCHEDULER_START", fmt.Sprintf("PID: %d", os.Getpid())))
+
+    for {
+        wake := s.tick(time.Now())
+        timer := time.NewTimer(time.Until(wake))
+        select {
+        case <-timer.C:
+        case sig := <-signals:
+            timer.Stop()
+            if sig == syscall.SIGHUP {
+                fmt.Println("Reloading the rules.")
+                continue
+            }
+            s.stop(sig)
+            logWarning(logEvent("SCHEDULER_STOP", fmt.Sprintf("Signal: %v", sig)))
+            fmt.Println("Baby scheduler stopped.")
+            return
+        }
+    }
+}
+
+// tick starts the rules that are due and returns when to wake up next.
+func (s *scheduler) tick(now time.Time) time.Time {
+    wake := now.Add(schedulerMaxSleep)
+
+    rules, err := loadScheduledRules()
+    if err != nil {
+        fmt.Println("Error loading the rules:", err)
+        return wake
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, rule := range rules {
+        due := nextRun(rule, s.states[rule.name], s.started)
+        // Runs skipped because of an overlap are not made up for later
+        for skipped := s.skipped[rule.name]; !due.IsZero() && !due.After(skipped); {
+            due = rule.sched.next(due)
+        }
+        if due.IsZero() {
+            continue
+        }
+        if due.After(now) {
+            if due.Before(wake) {
+                wake = due
+            }
+            continue
+        }
+
+        late := now.Sub(due) > schedulerLateness
+        if late && !rule.catchup {
+            // Forget the missed run and wait for the next one
+            s.states[rule.name] = &scheduleState{LastRun: now}
+            logWarning(writeLog(logEntry{Event: "SCHEDULE_MISSED", Rule: rule.name,
+                Details: fmt.Sprintf("Name: %s, Due: %s", rule.name, due.Format("2006-01-02 15:04:05"))}))
+            continue
+        }
+        if _, busy := s.running[rule.name]; busy {
+            s.skipped[rule.name] = due
+            fmt.Printf("Skipping rule '%s', its previous run is still going.\n", rule.name)
+            logWarning(writeLog(logEntry{Event: "SCHEDULE_SKIP", Rule: rule.name, Result: "skipped",
+                Details: fmt.Sprintf("Name: %s, Due: %s, Reason: previous run still running", rule.name, due.Format("2006-01-02 15:04:05"))}))
+            if next := rule.sched.next(due); !next.IsZero() && next.Before(wake) {
+                wake = next
+            }
+            continue
+        }
+        s.start(rule, due, late)
+        if next := rule.sched.next(now); !next.IsZero() && next.Before(wake) {
+            wake = next
+        }
+    }
+    return wake
+}
+
+// start runs a rule through a child baby process, so it goes through
+// runCommands and baby.log like any other run, with its output captured
+// to a file. It must be called with s.mu held.
+func (s *scheduler) start(rule scheduledRule, due time.Time, late bool) {
+    now := time.Now()
+    dir, err := babyStateDir(filepath.Join("scheduler", "output", rule.name))
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    outputPath := filepath.Join(dir, now.Format("20060102-150405")+".out")
+    output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+    if err != nil {
+        fmt.Println("Error creating the output file:", err)
+        return
+    }
+
+    executable, err := os.Executable()
+    if err != nil {
+        output.Close()
+        fmt.Println("Error finding the baby executable:", err)
+        return
+    }
+    // Nobody can answer a prompt here, rules that need confirmation only
+    // run when the scheduler was started with --yes
+    args := []string{"--no-prompt"}
+    if s.yes {
+        args = append(args, "--yes")
+    }
+    args = append(args, rule.name)
+
+    cmd := exec.Command(executable, args...)
+    cmd.Stdout = output
+    cmd.Stderr = output
+    started, err := sendBottles(cmd, s.bottles)
+    if err != nil {
+        output.Close()
+        fmt.Printf("Error starting rule '%s': %v\n", rule.name, err)
+        return
+    }
+    err = cmd.Start()
+    started()
+    if err != nil {
+        output.Close()
+        fmt.Printf("Error starting rule '%s': %v\n", rule.name, err)
+        return
+    }
+
+    s.states[rule.name] = &scheduleState{LastRun: now, LastExit: -1, Output: outputPath}
+    s.running[rule.name] = cmd
+    if err := saveScheduleState(s.states); err != nil {
+        fmt.Println("Warning: Failed to save the scheduler state:", err)
+    }
+
+    event := "SCHEDULE_RUN"
+    if late {
+        event = "SCHEDULE_CATCHUP"
+    }
+    fmt.Printf("Running rule '%s' (%s), output in %s\n", rule.name, rule.spec, outputPath)
+    logWarning(writeLog(logEntry{Event: event, Rule: rule.name,
+        Details: fmt.Sprintf("Name: %s, Due: %s, Output: %s", rule.name, due.Format("2006-01-02 15:04:05"), outputPath)}))
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        err := cmd.Wait()
+        output.Close()
+
+        exitCode := 0
+        if exitErr, ok := err.(*exec.ExitError); ok {
+            exitCode = exitErr.ExitCode()
+        } else if err != nil {
+            exitCode = 1
+        }
+        fmt.Printf("Rule '%s' finished with exit code %d\n", rule.name, exitCode)
+
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        delete(s.running, rule.name)
+        if state := s.states[rule.name]; state != nil && state.Output == outputPath {
+            state.LastExit = exitCode
+        }
+        if err := saveScheduleState(s.states); err != nil {
+            fmt.Println("Warning: Failed to save the scheduler state:", err)
+        }
+        pruneOutputs(dir, schedulerKeepOutputs)
+    }()
+}
+
+// stop forwards the signal to the running rules and waits for them.
+func (s *scheduler) stop(sig os.Signal) {
+    s.mu.Lock()
+    for name, cmd := range s.running {
+        fmt.Printf("Stopping rule '%s'.\n", name)
+        cmd.Process.Signal(sig)
+    }
+    s.mu.Unlock()
+    s.wg.Wait()
+}
+
+// pruneOutputs keeps only the newest keep files of dir.
+func pruneOutputs(dir string, keep int) {
+    paths, err := filepath.Glob(filepath.Join(dir, "*.out"))
+    if err != nil || len(paths) <= keep {
+        return
+    }
+    // The names are timestamps, so they sort by age
+    sort.Strings(paths)
+    for _, path := range paths[:len(paths)-keep] {
+        os.Remove(path)
+    }
+}
+
+// showSchedule lists the scheduled rules with their last and next runs.
+func showSchedule() {
+    rules, err := loadScheduledRules()
+    if err != nil {
+        fmt.Println("Error loading the rules:", err)
+        return
+    }
+    if len(rules) == 0 {
+        fmt.Println("No rules have a schedule. Add one with: baby -s <name> schedule 'every 15m'")
+        return
+    }
+    states, err := loadScheduleState()
+    if err != nil {
+        fmt.Println("Error reading the scheduler state:", err)
+        return
+    }
+
+    fmt.Printf("%-16s %-20s %-19s %-5s %s\n", "RULE", "SCHEDULE", "LAST RUN", "EXIT", "NEXT RUN")
+    for _, rule := range rules {
+        state := states[rule.name]
+        lastRun, exitCode := "-", "-"
+        if state != nil && !state.LastRun.IsZero() {
+            lastRun = state.LastRun.Format("2006-01-02 15:04:05")
+            if state.LastExit >= 0 {
+                exitCode = strconv.Itoa(state.LastExit)
+            }
+        }
+        nextRunText := "never"
+        if next := nextRun(rule, state, time.Now()); !next.IsZero() {
+            nextRunText = next.Format("2006-01-02 15:04:05")
+        }
+        fmt.Printf("%-16s %-20s %-19s %-5s %s\n", rule.name, rule.spec, lastRun, exitCode, nextRunText)
+    }
+}
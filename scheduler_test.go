@@ -0,0 +1,70 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+    zone := func(name string) *time.Location {
+        loc, err := time.LoadLocation(name)
+        if err != nil {
+            t.Skipf("time zone %s isn't available: %v", name, err)
+        }
+        return loc
+    }
+    newYork := zone("America/New_York")
+    kolkata := zone("Asia/Kolkata")
+    kathmandu := zone("Asia/Kathmandu")
+    santiago := zone("America/Santiago")
+
+    tests := []struct {
+        name  string
+        spec  string
+        after time.Time
+        want  time.Time
+    }{
+        {"next minute", "* * * * *",
+            time.Date(2026, 3, 10, 10, 15, 30, 0, time.UTC), time.Date(2026, 3, 10, 10, 16, 0, 0, time.UTC)},
+        {"next hour", "0 * * * *",
+            time.Date(2026, 3, 10, 10, 15, 0, 0, time.UTC), time.Date(2026, 3, 10, 11, 0, 0, 0, time.UTC)},
+        {"next day", "30 8 * * *",
+            time.Date(2026, 3, 10, 9, 0, 0, 0, time.UTC), time.Date(2026, 3, 11, 8, 30, 0, 0, time.UTC)},
+        {"weekday", "0 9 * * 1-5",
+            time.Date(2026, 3, 13, 10, 0, 0, 0, time.UTC), time.Date(2026, 3, 16, 9, 0, 0, 0, time.UTC)},
+        {"day of month or week", "0 0 1 * 0",
+            time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+        {"leap day", "0 0 29 2 *",
+            time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+        {"half hour zone", "0 * * * *",
+            time.Date(2026, 3, 10, 10, 15, 0, 0, kolkata), time.Date(2026, 3, 10, 11, 0, 0, 0, kolkata)},
+        {"half hour zone hour", "0 14 * * *",
+            time.Date(2026, 3, 10, 10, 15, 0, 0, kolkata), time.Date(2026, 3, 10, 14, 0, 0, 0, kolkata)},
+        {"quarter hour zone", "15 9 * * *",
+            time.Date(2026, 3, 10, 6, 0, 0, 0, kathmandu), time.Date(2026, 3, 10, 9, 15, 0, 0, kathmandu)},
+        {"hour after clocks go forward", "30 3 * * *",
+            time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 8, 3, 30, 0, 0, newYork)},
+        {"skipped hour", "30 2 * * *",
+            time.Date(2026, 3, 8, 1, 0, 0, 0, newYork), time.Date(2026, 3, 9, 2, 30, 0, 0, newYork)},
+        {"hour before clocks go back", "30 1 * * *",
+            time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 1, 1, 30, 0, 0, newYork)},
+        {"repeated hour runs once", "30 1 * * *",
+            time.Date(2026, 11, 1, 1, 30, 0, 0, newYork), time.Date(2026, 11, 2, 1, 30, 0, 0, newYork)},
+        {"hour after clocks go back", "0 2 * * *",
+            time.Date(2026, 11, 1, 0, 0, 0, 0, newYork), time.Date(2026, 11, 1, 2, 0, 0, 0, newYork)},
+        {"skipped midnight", "0 * 6 9 *",
+            time.Date(2026, 9, 5, 12, 0, 0, 0, santiago), time.Date(2026, 9, 6, 1, 0, 0, 0, santiago)},
+        {"never", "0 0 30 2 *",
+            time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC), time.Time{}},
+    }
+    for _, test := range tests {
+        s, err := parseSchedule(test.spec)
+        if err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        got := s.(cronSchedule).next(test.after)
+        if !got.Equal(test.want) {
+            t.Errorf("%s: next(%s) of '%s' = %s, want %s", test.name, test.after, test.spec, got, test.want)
+        }
+    }
+}
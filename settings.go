@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// settingsFileName holds the global settings, next to baby.conf, as
+// "<key> = <value>" lines. Lines starting with # are comments.
+const settingsFileName = "settings.conf"
+
+var (
+    settings     map[string]string
+    settingsOnce sync.Once
+)
+
+func settingsPath() string {
+    return filepath.Join(filepath.Dir(configFile), settingsFileName)
+}
+
+// getSetting returns the value of a global setting, or def when it is not
+// set. A missing settings file means every setting has its default.
+func getSetting(key, def string) string {
+    settingsOnce.Do(func() {
+        settings = make(map[string]string)
+        lines, err := readLines(settingsPath())
+        if err != nil {
+            return
+        }
+        for _, line := range lines {
+            line = strings.TrimSpace(line)
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            parts := strings.SplitN(line, "=", 2)
+            if len(parts) == 2 {
+                settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+            }
+        }
+    })
+    if value, ok := settings[key]; ok && value != "" {
+        return value
+    }
+    return def
+}
+
+func getBoolSetting(key string, def bool) bool {
+    value := getSetting(key, strconv.FormatBool(def))
+    b, err := strconv.ParseBool(value)
+    if err != nil {
+        fmt.Printf("Warning: Invalid value '%s' for setting '%s', using %v\n", value, key, def)
+        return def
+    }
+    return b
+}
+
+func getIntSetting(key string, def int) int {
+    value := getSetting(key, strconv.Itoa(def))
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        fmt.Printf("Warning: Invalid value '%s' for setting '%s', using %d\n", value, key, def)
+        return def
+    }
+    return n
+}
+
+func getDurationSetting(key string, def time.Duration) time.Duration {
+    value := getSetting(key, "")
+    if value == "" {
+        return def
+    }
+    d, err := parseAge(value)
+    if err != nil {
+        fmt.Printf("Warning: Invalid value '%s' for setting '%s', using %v\n", value, key, def)
+        return def
+    }
+    return d
+}
+
+// parseAge parses a duration that may also be given in days, e.g. 30d.
+func parseAge(value string) (time.Duration, error) {
+    if strings.HasSuffix(value, "d") {
+        days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+        if err != nil {
+            return 0, fmt.Errorf("invalid number of days '%s'", value)
+        }
+        return time.Duration(days) * 24 * time.Hour, nil
+    }
+    return time.ParseDuration(value)
+}
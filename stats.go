@@ -0,0 +1,332 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+)
+
+const (
+    defaultUnusedDays = 30
+    // A rule is slower than usual when the median of its last runs is
+    // this many times the median of the runs before them
+    defaultSlowdown = 1.5
+    recentRuns      = 5
+    // Differences below this are noise, whatever the ratio
+    minSlowdown = 100 * time.Millisecond
+)
+
+// statsOptions holds the arguments of baby stats.
+type statsOptions struct {
+    since      time.Time
+    unusedDays int
+    top        int
+    slowdown   float64
+    json       bool
+}
+
+// parseStatsArgs reads the arguments of baby stats.
+func parseStatsArgs(args []string) (so statsOptions, err error) {
+    so.unusedDays = defaultUnusedDays
+    so.slowdown = defaultSlowdown
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        if arg == "--json" {
+            so.json = true
+            continue
+        }
+        if i+1 >= len(args) {
+            return so, fmt.Errorf("unknown argument '%s'", arg)
+        }
+        value := args[i+1]
+        i++
+        switch arg {
+        case "--since":
+            if so.since, err = parseLogTime(value, false); err != nil {
+                return so, err
+            }
+        case "--unused":
+            if so.unusedDays, err = strconv.Atoi(value); err != nil || so.unusedDays <= 0 {
+                return so, fmt.Errorf("'%s' is not a number of days", value)
+            }
+        case "--top":
+            if so.top, err = strconv.Atoi(value); err != nil || so.top <= 0 {
+                return so, fmt.Errorf("'%s' is not a number of rules", value)
+            }
+        case "--slower":
+            if so.slowdown, err = strconv.ParseFloat(value, 64); err != nil || so.slowdown <= 1 {
+                return so, fmt.Errorf("'%s' should be a factor above 1, e.g. 1.5", value)
+            }
+        default:
+            return so, fmt.Errorf("unknown argument '%s'", arg)
+        }
+    }
+    return so, nil
+}
+
+// ruleStats is what baby stats reports for a rule. Durations are in
+// seconds and only count successful runs, failures often stop early.
+type ruleStats struct {
+    Rule        string    `json:"rule"`
+    Runs        int       `json:"runs"`
+    Failures    int       `json:"failures"`
+    FailureRate float64   `json:"failure_rate"`
+    LastRun     time.Time `json:"last_run"`
+    P50         float64   `json:"p50"`
+    P90         float64   `json:"p90"`
+    P99         float64   `json:"p99"`
+    Max         float64   `json:"max"`
+    // AvgCPU is the user and system CPU time of a run, in seconds
+    AvgCPU float64 `json:"avg_cpu"`
+    MaxRSS int64   `json:"max_rss_kb"`
+
+    durations []float64
+    cpu       float64
+    usageRuns int
+}
+
+type unusedRule struct {
+    Rule    string     `json:"rule"`
+    LastRun *time.Time `json:"last_run"`
+}
+
+type slowdown struct {
+    Rule     string  `json:"rule"`
+    Baseline float64 `json:"baseline"`
+    Recent   float64 `json:"recent"`
+    Factor   float64 `json:"factor"`
+}
+
+type statsReport struct {
+    Since       *time.Time   `json:"since,omitempty"`
+    Rules       []*ruleStats `json:"rules"`
+    UnusedDays  int          `json:"unused_days"`
+    Unused      []unusedRule `json:"unused"`
+    Regressions []slowdown   `json:"regressions"`
+}
+
+var (
+    textCommandRegexp  = regexp.MustCompile(`^Command: "(.*)", Result: `)
+    textDurationRegexp = regexp.MustCompile(` in ([0-9.]+[a-zµ]+)(,|$)`)
+    textUsageRegexp    = regexp.MustCompile(`CPU: user (\S+) sys (\S+), Max RSS: ([0-9.]+) (KB|MB|GB)`)
+)
+
+// completeTextEntry fills the fields of an EXECUTE_COMMAND event of the
+// text format from its details. Those don't have the rule name, it is
+// found from the command of the rules.
+func completeTextEntry(e *logEntry, ruleByCommand map[string]string) {
+    if m := textCommandRegexp.FindStringSubmatch(e.Details); m != nil {
+        e.Command = m[1]
+        e.Rule = ruleByCommand[m[1]]
+    }
+    if m := textDurationRegexp.FindStringSubmatch(e.Details); m != nil {
+        if d, err := time.ParseDuration(m[1]); err == nil {
+            seconds := d.Seconds()
+            e.Duration = &seconds
+        }
+    }
+    if m := textUsageRegexp.FindStringSubmatch(e.Details); m != nil {
+        user, err1 := time.ParseDuration(m[1])
+        sys, err2 := time.ParseDuration(m[2])
+        rss, err3 := strconv.ParseFloat(m[3], 64)
+        if err1 == nil && err2 == nil && err3 == nil {
+            rss *= map[string]float64{"KB": 1, "MB": 1024, "GB": 1024 * 1024}[m[4]]
+            e.Usage = &resourceUsage{UserCPU: user, SystemCPU: sys, MaxRSS: int64(rss)}
+        }
+    }
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+    if len(sorted) == 0 {
+        return 0
+    }
+    rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+    if rank < 0 {
+        rank = 0
+    }
+    return sorted[rank]
+}
+
+func median(values []float64) float64 {
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    return percentile(sorted, 50)
+}
+
+// buildStats reads the EXECUTE_COMMAND events of the log, rotated logs
+// included, and aggregates them per rule.
+func buildStats(so statsOptions) (*statsReport, error) {
+    rules, err := loadRules()
+    if err != nil {
+        return nil, err
+    }
+    ruleByCommand := make(map[string]string)
+    for _, rule := range rules {
+        ruleByCommand[rule.Command] = rule.Name
+    }
+
+    byRule := make(map[string]*ruleStats)
+    // --since doesn't apply to the unused rules, they need the last run
+    lastRun := make(map[string]time.Time)
+    add := func(e logEntry) {
+        if e.Event != "EXECUTE_COMMAND" {
+            return
+        }
+        if e.Result == "" || e.Rule == "" {
+            completeTextEntry(&e, ruleByCommand)
+        }
+        if e.Rule == "" {
+            return
+        }
+        if e.Time.After(lastRun[e.Rule]) {
+            lastRun[e.Rule] = e.Time
+        }
+        if !so.since.IsZero() && e.Time.Before(so.since) {
+            return
+        }
+        s := byRule[e.Rule]
+        if s == nil {
+            s = &ruleStats{Rule: e.Rule}
+            byRule[e.Rule] = s
+        }
+        s.Runs++
+        if e.Time.After(s.LastRun) {
+            s.LastRun = e.Time
+        }
+        if isFailure(e) {
+            s.Failures++
+        } else if e.Duration != nil {
+            s.durations = append(s.durations, *e.Duration)
+        }
+        if e.Usage != nil {
+            s.cpu += (e.Usage.UserCPU + e.Usage.SystemCPU).Seconds()
+            s.usageRuns++
+            if e.Usage.MaxRSS > s.MaxRSS {
+                s.MaxRSS = e.Usage.MaxRSS
+            }
+        }
+    }
+    path := logPath()
+    for _, rotated := range rotatedLogs(path) {
+        if err := readLogFile(rotated, add); err != nil {
+            fmt.Printf("Warning: %v\n", err)
+        }
+    }
+    if err := readLogFile(path, add); err != nil && !os.IsNotExist(err) {
+        return nil, fmt.Errorf("failed to read the log: %v", err)
+    }
+
+    report := &statsReport{UnusedDays: so.unusedDays, Unused: []unusedRule{}, Regressions: []slowdown{}}
+    if !so.since.IsZero() {
+        report.Since = &so.since
+    }
+    for _, s := range byRule {
+        s.FailureRate = float64(s.Failures) / float64(s.Runs)
+        if s.usageRuns > 0 {
+            s.AvgCPU = s.cpu / float64(s.usageRuns)
+        }
+        // The log is in time order, the last runs are at the end
+        if n := len(s.durations); n >= 2*recentRuns {
+            baseline, recent := median(s.durations[:n-recentRuns]), median(s.durations[n-recentRuns:])
+            if baseline > 0 && recent >= baseline*so.slowdown && recent-baseline >= minSlowdown.Seconds() {
+                report.Regressions = append(report.Regressions, slowdown{Rule: s.Rule, Baseline: baseline, Recent: recent, Factor: recent / baseline})
+            }
+        }
+        sorted := append([]float64(nil), s.durations...)
+        sort.Float64s(sorted)
+        s.P50, s.P90, s.P99 = percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99)
+        if len(sorted) > 0 {
+            s.Max = sorted[len(sorted)-1]
+        }
+        report.Rules = append(report.Rules, s)
+    }
+    sort.Slice(report.Rules, func(i, j int) bool {
+        if report.Rules[i].Runs != report.Rules[j].Runs {
+            return report.Rules[i].Runs > report.Rules[j].Runs
+        }
+        return report.Rules[i].Rule < report.Rules[j].Rule
+    })
+    if so.top > 0 && len(report.Rules) > so.top {
+        report.Rules = report.Rules[:so.top]
+    }
+    sort.Slice(report.Regressions, func(i, j int) bool { return report.Regressions[i].Factor > report.Regressions[j].Factor })
+
+    cutoff := time.Now().AddDate(0, 0, -so.unusedDays)
+    for _, rule := range rules {
+        last, ok := lastRun[rule.Name]
+        if !ok {
+            report.Unused = append(report.Unused, unusedRule{Rule: rule.Name})
+        } else if last.Before(cutoff) {
+            report.Unused = append(report.Unused, unusedRule{Rule: rule.Name, LastRun: &last})
+        }
+    }
+    return report, nil
+}
+
+func formatSeconds(seconds float64) string {
+    return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// showStats prints how the rules were used according to the log.
+func showStats(so statsOptions) error {
+    report, err := buildStats(so)
+    if err != nil {
+        return err
+    }
+    if so.json {
+        data, err := json.MarshalIndent(report, "", "  ")
+        if err != nil {
+            return err
+        }
+        fmt.Println(string(data))
+        return nil
+    }
+
+    if len(report.Rules) == 0 {
+        fmt.Println("No runs found in the log.")
+    } else {
+        title := "Most used rules"
+        if report.Since != nil {
+            title += " since " + report.Since.Format(logTimeFormat)
+        }
+        fmt.Println(title + ":")
+        fmt.Printf("%-20s %6s %6s %10s %10s %10s %10s %10s %10s  %s\n",
+            "RULE", "RUNS", "FAIL%", "P50", "P90", "P99", "MAX", "AVG CPU", "MAX RSS", "LAST RUN")
+        for _, s := range report.Rules {
+            rss := "-"
+            if s.MaxRSS > 0 {
+                rss = formatKilobytes(s.MaxRSS)
+            }
+            fmt.Printf("%-20s %6d %5.1f%% %10s %10s %10s %10s %10s %10s  %s\n",
+                s.Rule, s.Runs, s.FailureRate*100, formatSeconds(s.P50), formatSeconds(s.P90), formatSeconds(s.P99),
+                formatSeconds(s.Max), formatSeconds(s.AvgCPU), rss, s.LastRun.Local().Format(logTimeFormat))
+        }
+    }
+
+    if len(report.Unused) > 0 {
+        fmt.Printf("\nNot used in the last %d days:\n", report.UnusedDays)
+        for _, u := range report.Unused {
+            if u.LastRun == nil {
+                fmt.Printf("  %s (never run)\n", u.Rule)
+            } else {
+                fmt.Printf("  %s (last run %s)\n", u.Rule, u.LastRun.Local().Format("2006-01-02"))
+            }
+        }
+    }
+
+    if len(report.Regressions) > 0 {
+        fmt.Println("\nSlower than usual:")
+        for _, r := range report.Regressions {
+            fmt.Printf("  %s: the last %d runs took %s against %s before (%.1fx)\n",
+                r.Rule, recentRuns, formatSeconds(r.Recent), formatSeconds(r.Baseline), r.Factor)
+        }
+    }
+    return nil
+}
+
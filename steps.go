@@ -0,0 +1,246 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// ruleStep is a named step of a rule, stored as a "step" option with the
+// value "<name>: <command>".
+type ruleStep struct {
+    name    string
+    command string
+}
+
+// parseStep reads the value of a step option.
+func parseStep(value string) (ruleStep, error) {
+    parts := strings.SplitN(value, ":", 2)
+    name := strings.TrimSpace(parts[0])
+    if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") || strings.TrimSpace(parts[1]) == "" {
+        return ruleStep{}, fmt.Errorf("'%s' should be '<step name>: <command>'", value)
+    }
+    return ruleStep{name: name, command: strings.TrimSpace(parts[1])}, nil
+}
+
+// ruleSteps returns the steps of a rule in the order they run.
+func ruleSteps(rule *Rule) ([]ruleStep, error) {
+    var steps []ruleStep
+    seen := make(map[string]bool)
+    for _, value := range rule.Options["step"] {
+        step, err := parseStep(value)
+        if err != nil {
+            return nil, fmt.Errorf("invalid step in rule '%s': %v", rule.Name, err)
+        }
+        if seen[step.name] {
+            return nil, fmt.Errorf("rule '%s' has two steps named '%s'", rule.Name, step.name)
+        }
+        seen[step.name] = true
+        steps = append(steps, step)
+    }
+    return steps, nil
+}
+
+// stepCheckpoint records the steps of a rule that succeeded in its last
+// run, in steps/<rule>.json in the state directory. It holds the bottle
+// values of the run so baby resume can reuse them, so it is only readable
+// by the user.
+type stepCheckpoint struct {
+    Rule      string            `json:"rule"`
+    RunID     string            `json:"run_id"`
+    Bottles   map[string]string `json:"bottles,omitempty"`
+    Completed []string          `json:"completed"`
+    Failed    string            `json:"failed,omitempty"`
+    Updated   time.Time         `json:"updated"`
+}
+
+func checkpointPath(rule string) (string, error) {
+    dir, err := babyStateDir("steps")
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, strings.ReplaceAll(rule, "/", "%2F")+".json"), nil
+}
+
+func loadCheckpoint(rule string) (*stepCheckpoint, error) {
+    path, err := checkpointPath(rule)
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("failed to read the checkpoint of rule '%s': %v", rule, err)
+    }
+    var checkpoint stepCheckpoint
+    if err := json.Unmarshal(data, &checkpoint); err != nil {
+        return nil, fmt.Errorf("failed to read the checkpoint of rule '%s': %v", rule, err)
+    }
+    return &checkpoint, nil
+}
+
+func saveCheckpoint(checkpoint *stepCheckpoint) error {
+    path, err := checkpointPath(checkpoint.Rule)
+    if err != nil {
+        return err
+    }
+    checkpoint.Updated = time.Now()
+    data, err := json.MarshalIndent(checkpoint, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return fmt.Errorf("failed to write the checkpoint of rule '%s': %v", checkpoint.Rule, err)
+    }
+    return os.Rename(tmp, path)
+}
+
+func removeCheckpoint(rule string) {
+    if path, err := checkpointPath(rule); err == nil {
+        os.Remove(path)
+    }
+}
+
+// executeSteps runs the steps of the i-th rule of a run one after the
+// other, each with the retries of the rule. Every step that succeeds is
+// checkpointed, so when one fails baby resume can continue from it. With
+// resume, the steps that succeeded in the last run are skipped.
+func executeSteps(i int, p *preparedRule, runID string, resume bool) (int, error) {
+    // Secret bottles stay out of the file like they stay out of the
+    // history, baby resume asks for them again
+    bottles := make(map[string]string)
+    for name, value := range p.bottles {
+        if !secretBottleRegexp.MatchString(name) {
+            bottles[name] = value
+        }
+    }
+    checkpoint := &stepCheckpoint{Rule: p.rule.Name, RunID: runID, Bottles: bottles}
+    done := make(map[string]bool)
+    if resume {
+        previous, err := loadCheckpoint(p.rule.Name)
+        if err != nil {
+            return 0, err
+        }
+        if previous != nil {
+            checkpoint.Completed = previous.Completed
+            for _, name := range previous.Completed {
+                done[name] = true
+            }
+        }
+    }
+
+    attempts := 0
+    for n, step := range p.steps {
+        progress := fmt.Sprintf("[%d/%d]", n+1, len(p.steps))
+        if done[step.name] {
+            fmt.Printf("%s Step '%s' already done, skipping it\n", progress, step.name)
+            continue
+        }
+        fmt.Printf("%s Step '%s': %s\n", progress, step.name, step.command)
+        if p.output != nil {
+            fmt.Fprintf(p.output, "--- step %s ---\n", step.name)
+        }
+
+        stepRule := *p
+        stepRule.command = step.command
+        start := time.Now()
+        stepAttempts, err := executeWithRetries(i, &stepRule)
+        duration := time.Since(start)
+        attempts += stepAttempts
+
+        result := "Success"
+        if err != nil {
+            result = fmt.Sprintf("Error: %v", err)
+        }
+        status := "success"
+        if err != nil {
+            status = "failed"
+        }
+        logWarning(writeLog(logEntry{Event: "EXECUTE_STEP", Rule: p.rule.Name, Command: step.command, RunID: runID, Result: status,
+            Details: fmt.Sprintf("Name: %s, Step: %s, Command: \"%s\", Result: %s in %v, Run: %s",
+                p.rule.Name, step.name, step.command, result, duration, runID)}.withExit(err, duration)))
+
+        if err != nil {
+            checkpoint.Failed = step.name
+            if saveErr := saveCheckpoint(checkpoint); saveErr != nil {
+                fmt.Printf("Warning: %v\n", saveErr)
+            } else {
+                fmt.Printf("%s Step '%s' failed after %v. Use 'baby resume %s' to continue from it.\n",
+                    progress, step.name, duration.Round(time.Millisecond), p.rule.Name)
+            }
+            // The error keeps its type, it decides the exit code of baby
+            return attempts, err
+        }
+        fmt.Printf("%s Step '%s' done in %v\n", progress, step.name, duration.Round(time.Millisecond))
+
+        checkpoint.Completed = append(checkpoint.Completed, step.name)
+        if err := saveCheckpoint(checkpoint); err != nil {
+            fmt.Printf("Warning: %v\n", err)
+        }
+    }
+    removeCheckpoint(p.rule.Name)
+    return attempts, nil
+}
+
+// resumeRule runs a rule again from the step that failed in its last run,
+// with the bottle values of that run. Secret bottles are asked for again.
+func resumeRule(name string, bottleValues map[string]string, opts runOptions) error {
+    checkpoint, err := loadCheckpoint(name)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return err
+    }
+    if checkpoint == nil {
+        fmt.Printf("Rule '%s' has no failed run to resume.\n", name)
+        return fmt.Errorf("rule '%s' has no failed run to resume", name)
+    }
+
+    // Bottles given on the command line win over the recorded ones
+    for bottle, value := range checkpoint.Bottles {
+        if _, ok := bottleValues[bottle]; !ok {
+            bottleValues[bottle] = value
+        }
+    }
+    if checkpoint.Failed != "" {
+        fmt.Printf("Resuming rule '%s' from step '%s'.\n", name, checkpoint.Failed)
+    }
+    opts.resume = true
+    return runCommands([]string{name}, bottleValues, opts)
+}
+
+// listCheckpoints prints the rules that can be resumed.
+func listCheckpoints() {
+    dir, err := babyStateDir("steps")
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+    sort.Strings(paths)
+
+    found := false
+    for _, path := range paths {
+        rule := strings.ReplaceAll(strings.TrimSuffix(filepath.Base(path), ".json"), "%2F", "/")
+        checkpoint, err := loadCheckpoint(rule)
+        if err != nil || checkpoint == nil {
+            continue
+        }
+        found = true
+        status := "was interrupted"
+        if checkpoint.Failed != "" {
+            status = fmt.Sprintf("failed at step '%s'", checkpoint.Failed)
+        }
+        fmt.Printf("%s: %s on %s, %d step(s) done\n", rule, status,
+            checkpoint.Updated.Format("2006-01-02 15:04:05"), len(checkpoint.Completed))
+    }
+    if !found {
+        fmt.Println("No rules to resume.")
+    }
+}
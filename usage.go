@@ -0,0 +1,83 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "syscall"
+    "time"
+)
+
+// resourceUsage is what the processes of a rule used, summed over its
+// attempts and steps. It comes from the rusage of the bash process, which
+// includes the processes it waited for.
+type resourceUsage struct {
+    UserCPU   time.Duration `json:"user_cpu_ns"`
+    SystemCPU time.Duration `json:"system_cpu_ns"`
+    // MaxRSS is the largest resident set of a single process, in kilobytes
+    MaxRSS int64 `json:"max_rss_kb"`
+    // ReadBlocks and WriteBlocks count the 512 byte blocks of file system
+    // input and output
+    ReadBlocks  int64 `json:"read_blocks"`
+    WriteBlocks int64 `json:"write_blocks"`
+}
+
+// add adds the usage of a finished process.
+func (u *resourceUsage) add(state *os.ProcessState) {
+    if u == nil || state == nil {
+        return
+    }
+    u.UserCPU += state.UserTime()
+    u.SystemCPU += state.SystemTime()
+    rusage, ok := state.SysUsage().(*syscall.Rusage)
+    if !ok {
+        return
+    }
+    if rusage.Maxrss > u.MaxRSS {
+        u.MaxRSS = rusage.Maxrss
+    }
+    u.ReadBlocks += rusage.Inblock
+    u.WriteBlocks += rusage.Oublock
+}
+
+func (u *resourceUsage) String() string {
+    return fmt.Sprintf("CPU: user %v sys %v, Max RSS: %s, Blocks: in %d out %d",
+        u.UserCPU.Round(time.Millisecond), u.SystemCPU.Round(time.Millisecond),
+        formatKilobytes(u.MaxRSS), u.ReadBlocks, u.WriteBlocks)
+}
+
+// formatKilobytes shows a size in kilobytes with a readable unit.
+func formatKilobytes(kb int64) string {
+    switch {
+    case kb >= 1024*1024:
+        return fmt.Sprintf("%.1f GB", float64(kb)/(1024*1024))
+    case kb >= 1024:
+        return fmt.Sprintf("%.1f MB", float64(kb)/1024)
+    }
+    return fmt.Sprintf("%d KB", kb)
+}
+
+// usageSummaryEnabled reports whether the resource usage of the rules is
+// shown at the end of a run.
+func usageSummaryEnabled(opts runOptions) bool {
+    return opts.usage || getBoolSetting("usage.summary", false)
+}
+
+// showUsageSummary prints the resource usage of the rules that ran.
+func showUsageSummary(results []HistoryResult) {
+    header := false
+    for _, result := range results {
+        if result.Usage == nil {
+            continue
+        }
+        if !header {
+            fmt.Println()
+            fmt.Printf("%-20s %-10s %-10s %-10s %-10s %-10s %s\n", "RULE", "STATUS", "WALL", "USER", "SYS", "MAX RSS", "BLOCKS IN/OUT")
+            header = true
+        }
+        u := result.Usage
+        wall := time.Duration(result.Duration * float64(time.Second))
+        fmt.Printf("%-20s %-10s %-10v %-10v %-10v %-10s %d/%d\n", result.Rule, result.Status,
+            wall.Round(time.Millisecond), u.UserCPU.Round(time.Millisecond), u.SystemCPU.Round(time.Millisecond),
+            formatKilobytes(u.MaxRSS), u.ReadBlocks, u.WriteBlocks)
+    }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+    "strings"
+    "sync"
+)
+
+// variantPrefix starts the options that hold a distribution specific
+// command, e.g. "update.variant.debian = sudo apt update".
+const variantPrefix = "variant."
+
+// osRelease holds the ID and ID_LIKE fields of /etc/os-release.
+type osRelease struct {
+    id     string
+    idLike []string
+}
+
+var (
+    currentOSRelease     osRelease
+    currentOSReleaseOnce sync.Once
+)
+
+// readOSRelease returns the distribution of this machine, read once from
+// /etc/os-release or /usr/lib/os-release.
+func readOSRelease() osRelease {
+    currentOSReleaseOnce.Do(func() {
+        for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+            lines, err := readLines(path)
+            if err != nil {
+                continue
+            }
+            for _, line := range lines {
+                parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+                if len(parts) != 2 {
+                    continue
+                }
+                value := strings.ToLower(strings.Trim(parts[1], `"'`))
+                switch parts[0] {
+                case "ID":
+                    currentOSRelease.id = value
+                case "ID_LIKE":
+                    currentOSRelease.idLike = strings.Fields(value)
+                }
+            }
+            return
+        }
+    })
+    return currentOSRelease
+}
+
+// ids lists the distribution ids to try, most specific first.
+func (r osRelease) ids() []string {
+    var ids []string
+    if r.id != "" {
+        ids = append(ids, r.id)
+    }
+    return append(ids, r.idLike...)
+}
+
+// selectVariant returns the command of a rule for this machine: the
+// variant matching ID, else the first one matching ID_LIKE, else the
+// rule's own command. variant is empty when no variant applies.
+func selectVariant(rule *Rule) (command, variant string) {
+    for _, id := range readOSRelease().ids() {
+        if value := rule.option(variantPrefix + id); value != "" {
+            return value, id
+        }
+    }
+    return rule.Command, ""
+}
+
+// hasVariants reports whether a rule has any distribution variant.
+func hasVariants(rule *Rule) bool {
+    for key := range rule.Options {
+        if strings.HasPrefix(key, variantPrefix) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "fmt"
+    "io/fs"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+const defaultWatchDebounce = 300 * time.Millisecond
+
+// watchEvents are the inotify events that count as a change.
+const watchEvents = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// watchOptions holds the arguments of baby watch.
+type watchOptions struct {
+    paths    []string
+    globs    []string
+    debounce time.Duration
+    // restart stops a run that is still going when files change again
+    restart bool
+}
+
+// parseWatchArgs reads the arguments of baby watch.
+func parseWatchArgs(args []string) (rule string, wo watchOptions, ok bool) {
+    wo.debounce = getDurationSetting("watch.debounce", defaultWatchDebounce)
+    wo.restart = getBoolSetting("watch.restart", false)
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--path" && i+1 < len(args):
+            wo.paths = append(wo.paths, args[i+1])
+            i++
+        case args[i] == "--glob" && i+1 < len(args):
+            if _, err := filepath.Match(args[i+1], ""); err != nil {
+                return "", wo, false
+            }
+            wo.globs = append(wo.globs, args[i+1])
+            i++
+        case args[i] == "--debounce" && i+1 < len(args):
+            d, err := time.ParseDuration(args[i+1])
+            if err != nil || d < 0 {
+                return "", wo, false
+            }
+            wo.debounce = d
+            i++
+        case args[i] == "--restart":
+            wo.restart = true
+        case strings.HasPrefix(args[i], "-") || rule != "":
+            return "", wo, false
+        default:
+            rule = args[i]
+        }
+    }
+    if len(wo.paths) == 0 {
+        wo.paths = []string{"."}
+    }
+    return rule, wo, rule != ""
+}
+
+// watcher reports the changed files under a set of directories through
+// inotify. inotify doesn't watch subdirectories, so every directory gets
+// its own watch, including the ones created later.
+type watcher struct {
+    fd      int
+    dirs    map[int]string
+    globs   []string
+    ignored map[string]bool
+}
+
+func newWatcher(paths, globs []string) (*watcher, error) {
+    fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+    if err != nil {
+        return nil, fmt.Errorf("failed to start inotify: %v", err)
+    }
+    w := &watcher{fd: fd, dirs: make(map[int]string), globs: globs, ignored: make(map[string]bool)}
+    for _, path := range paths {
+        info, err := os.Stat(path)
+        if err != nil {
+            unix.Close(fd)
+            return nil, fmt.Errorf("can't watch %s: %v", path, err)
+        }
+        if !info.IsDir() {
+            // A single file is watched through its directory
+            w.globs = append(w.globs, filepath.Base(path))
+            path = filepath.Dir(path)
+        }
+        if err := w.addTree(path); err != nil {
+            unix.Close(fd)
+            return nil, err
+        }
+    }
+    return w, nil
+}
+
+// addTree watches a directory and the directories under it. Hidden
+// directories such as .git are left out.
+func (w *watcher) addTree(root string) error {
+    return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || !entry.IsDir() {
+            return nil
+        }
+        if path != root && strings.HasPrefix(entry.Name(), ".") {
+            return filepath.SkipDir
+        }
+        wd, err := unix.InotifyAddWatch(w.fd, path, watchEvents)
+        if err != nil {
+            return fmt.Errorf("can't watch %s: %v", path, err)
+        }
+        w.dirs[wd] = path
+        return nil
+    })
+}
+
+// ignore leaves out files the runs write themselves, such as reports, so
+// they don't start a run again.
+func (w *watcher) ignore(path string) {
+    if abs, err := filepath.Abs(path); err == nil {
+        w.ignored[abs] = true
+    }
+}
+
+// matches reports whether a changed file is one the rule cares about.
+func (w *watcher) matches(path string) bool {
+    if abs, err := filepath.Abs(path); err == nil && w.ignored[abs] {
+        return false
+    }
+    if len(w.globs) == 0 {
+        return true
+    }
+    for _, glob := range w.globs {
+        if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+            return true
+        }
+        if ok, _ := filepath.Match(glob, path); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// run reads inotify events until the descriptor fails and sends the
+// changed files that match.
+func (w *watcher) run(changes chan<- string) {
+    buf := make([]byte, 64*1024)
+    for {
+        n, err := unix.Read(w.fd, buf)
+        if err == unix.EINTR {
+            continue
+        }
+        if err != nil || n <= 0 {
+            return
+        }
+        for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+            event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+            nameStart := offset + unix.SizeofInotifyEvent
+            name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+            offset = nameStart + int(event.Len)
+
+            dir, ok := w.dirs[int(event.Wd)]
+            if !ok || name == "" {
+                continue
+            }
+            path := filepath.Join(dir, name)
+            if event.Mask&unix.IN_ISDIR != 0 {
+                if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && !strings.HasPrefix(name, ".") {
+                    w.addTree(path)
+                }
+                continue
+            }
+            if w.matches(path) {
+                changes <- path
+            }
+        }
+    }
+}
+
+// watchRule runs a rule and runs it again every time a watched file
+// changes. Bursts of changes are merged into one run. The bottles and the
+// confirmation are asked for once, every run reuses them.
+func watchRule(name string, wo watchOptions, bottleValues map[string]string, opts runOptions) {
+    rule, err := loadRule(name)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    p, err := prepareRule(rule, bottleValues, opts)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    if !confirmRule(p, opts) {
+        fmt.Println("Operation cancelled.")
+        return
+    }
+
+    w, err := newWatcher(wo.paths, wo.globs)
+    if err != nil {
+        fmt.Println("Error:", err)
+        return
+    }
+    defer unix.Close(w.fd)
+    for _, report := range opts.reports {
+        w.ignore(report.path)
+    }
+    if opts.recordPath != "" {
+        w.ignore(opts.recordPath)
+    }
+
+    changes := make(chan string, 64)
+    go w.run(changes)
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    defer signal.Stop(signals)
+
+    fmt.Printf("Watching %s for rule '%s'. Press ctrl+c to quit\n", strings.Join(wo.paths, ", "), name)
+    logWarning(writeLog(logEntry{Event: "WATCH_START", Rule: name,
+        Details: fmt.Sprintf("Name: %s, Paths: %s, Globs: %s", name, strings.Join(wo.paths, " "), strings.Join(wo.globs, " "))}))
+
+    var current *exec.Cmd
+    finished := make(chan error, 1)
+    runs := 0
+    start := func(reason string) {
+        runs++
+        fmt.Printf("\n=== Run %d of '%s' at %s, %s ===\n", runs, name, time.Now().Format("15:04:05"), reason)
+        current, err = startWatchRun(name, p.bottles, opts)
+        if err != nil {
+            fmt.Println("Error:", err)
+            current = nil
+            return
+        }
+        started := time.Now()
+        go func(cmd *exec.Cmd, run int) {
+            err := cmd.Wait()
+            fmt.Printf("=== Run %d of '%s' finished with exit code %d in %v ===\n",
+                run, name, cmd.ProcessState.ExitCode(), time.Since(started).Round(time.Millisecond))
+            finished <- err
+        }(current, runs)
+    }
+
+    start("first run")
+    var debounce <-chan time.Time
+    var changed string
+    pending := false
+    for {
+        select {
+        case path := <-changes:
+            changed = path
+            debounce = time.After(wo.debounce)
+        case <-debounce:
+            debounce = nil
+            reason := fmt.Sprintf("%s changed", changed)
+            if current == nil {
+                start(reason)
+                continue
+            }
+            pending = true
+            if wo.restart {
+                fmt.Printf("=== %s, stopping the run ===\n", reason)
+                current.Process.Signal(syscall.SIGTERM)
+            }
+        case <-finished:
+            current = nil
+            if pending {
+                pending = false
+                start(fmt.Sprintf("%s changed", changed))
+            }
+        case sig := <-signals:
+            if current != nil {
+                current.Process.Signal(sig)
+                <-finished
+            }
+            logWarning(writeLog(logEntry{Event: "WATCH_STOP", Rule: name, Details: fmt.Sprintf("Name: %s, Runs: %d", name, runs)}))
+            return
+        }
+    }
+}
+
+// startWatchRun runs the rule in a baby child process, like the scheduler
+// does, so a run can be stopped without stopping the watch.
+func startWatchRun(name string, bottleValues map[string]string, opts runOptions) (*exec.Cmd, error) {
+    executable, err := os.Executable()
+    if err != nil {
+        return nil, fmt.Errorf("failed to find the baby executable: %v", err)
+    }
+    // The rule was confirmed and its bottles filled when the watch started
+    args := []string{"--no-prompt", "--yes"}
+    if opts.timeout > 0 {
+        args = append(args, "--timeout="+opts.timeout.String())
+    }
+    if opts.sandbox {
+        args = append(args, "--sandbox")
+    }
+    if opts.usage {
+        args = append(args, "--usage")
+    }
+    if opts.record && opts.recordPath != "" {
+        args = append(args, "--record="+opts.recordPath)
+    } else if opts.record {
+        args = append(args, "--record")
+    }
+    for _, report := range opts.reports {
+        args = append(args, "--report="+report.format+"="+report.path)
+    }
+    args = append(args, name)
+
+    cmd := exec.Command(executable, args...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    started, err := sendBottles(cmd, bottleValues)
+    if err != nil {
+        return nil, fmt.Errorf("failed to start rule '%s': %v", name, err)
+    }
+    err = cmd.Start()
+    started()
+    if err != nil {
+        return nil, fmt.Errorf("failed to start rule '%s': %v", name, err)
+    }
+    return cmd, nil
+}